@@ -0,0 +1,41 @@
+// Package backplane carries hub traffic between midi-server instances, so
+// several of them can sit behind a load balancer and play as one. Local is
+// an in-process bus; Server and Client speak a subset of the NATS text
+// protocol over TCP, so instances can share a Server hosted by one of them
+// or a real NATS server.
+package backplane
+
+import "errors"
+
+var (
+	// ErrClosed is returned once a backplane has been closed.
+	ErrClosed = errors.New("backplane: closed")
+	// ErrDisconnected is returned by Publish while a Client is
+	// reconnecting. The message is dropped.
+	ErrDisconnected = errors.New("backplane: not connected")
+	// ErrFull is returned by Publish when messages are being published
+	// faster than they can be sent. The message is dropped.
+	ErrFull = errors.New("backplane: send buffer full")
+)
+
+// Handler receives a message published on a subscribed subject. Messages
+// on one subscription are handled one at a time, in the order they were
+// published.
+type Handler func(subject string, data []byte)
+
+// Backplane is a publish/subscribe bus. Subscribers receive everything
+// published on their subject, including their own messages, so callers
+// that don't want those should mark them with their origin.
+type Backplane interface {
+	Publish(subject string, data []byte) error
+	Subscribe(subject string, h Handler) error
+	Stats() Stats
+	Close() error
+}
+
+type Stats struct {
+	Connected bool   `json:"connected"`
+	Published uint64 `json:"published"`
+	Received  uint64 `json:"received"`
+	Dropped   uint64 `json:"dropped"` // not published, or not handled in time
+}
@@ -0,0 +1,223 @@
+package backplane
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// recorder collects what a subscription receives.
+type recorder struct {
+	mu   sync.Mutex
+	msgs []string
+}
+
+func (r *recorder) handle(subject string, data []byte) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.msgs = append(r.msgs, subject+":"+string(data))
+}
+
+// wait polls until n messages have arrived, returning them.
+func (r *recorder) wait(t *testing.T, n int) []string {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		r.mu.Lock()
+		got := append([]string(nil), r.msgs...)
+		r.mu.Unlock()
+		if len(got) >= n || time.Now().After(deadline) {
+			if len(got) != n {
+				t.Fatalf("got %d messages %v, want %d", len(got), got, n)
+			}
+			return got
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestLocal(t *testing.T) {
+	l := NewLocal()
+	var a, b, other recorder
+	l.Subscribe("hub", a.handle)
+	l.Subscribe("hub", b.handle)
+	l.Subscribe("other", other.handle)
+
+	for i := 0; i < 3; i++ {
+		if err := l.Publish("hub", []byte(fmt.Sprint(i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want := "[hub:0 hub:1 hub:2]"
+	for _, r := range []*recorder{&a, &b} {
+		if got := fmt.Sprint(r.wait(t, 3)); got != want {
+			t.Errorf("got %s, want %s", got, want)
+		}
+	}
+	other.wait(t, 0)
+
+	if s := l.Stats(); s.Published != 3 || s.Dropped != 0 || !s.Connected {
+		t.Errorf("stats = %+v", s)
+	}
+	l.Close()
+	if err := l.Publish("hub", nil); err != ErrClosed {
+		t.Errorf("publish after close: %v", err)
+	}
+}
+
+// broker starts a Server on a free port.
+func broker(t *testing.T, addr string) *Server {
+	t.Helper()
+	s, err := Listen(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Serve(context.Background())
+	return s
+}
+
+func dial(t *testing.T, s *Server) *Client {
+	t.Helper()
+	c, err := Dial("nats://" + s.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	go c.Serve(context.Background())
+	t.Cleanup(func() { c.Close() })
+	return c
+}
+
+func TestClientServer(t *testing.T) {
+	s := broker(t, "127.0.0.1:0")
+	defer s.Close()
+	a, b := dial(t, s), dial(t, s)
+
+	var gotA, gotB, other recorder
+	a.Subscribe("hub", gotA.handle)
+	b.Subscribe("hub", gotB.handle)
+	b.Subscribe("other", other.handle)
+	// A PING round trip means the server has seen the SUBs.
+	syncWith(t, s)
+
+	// Order is kept per publisher; wait so a's message comes first.
+	a.Publish("hub", []byte(`{"note":60}`))
+	gotA.wait(t, 1)
+	gotB.wait(t, 1)
+	b.Publish("hub", []byte("with spaces\r\nand lines"))
+	b.Publish("hub", nil)
+
+	want := "[hub:{\"note\":60} hub:with spaces\r\nand lines hub:]"
+	for name, r := range map[string]*recorder{"a": &gotA, "b": &gotB} {
+		if got := fmt.Sprint(r.wait(t, 3)); got != want {
+			t.Errorf("%s got %q, want %q", name, got, want)
+		}
+	}
+	other.wait(t, 0)
+	if st := a.Stats(); !st.Connected || st.Published != 1 || st.Received != 3 {
+		t.Errorf("a stats = %+v", st)
+	}
+	if err := a.Publish("bad subject", nil); err == nil {
+		t.Error("published on a subject with a space")
+	}
+}
+
+// syncWith makes a raw connection and waits for a PONG, so the server has
+// handled everything sent to it before.
+func syncWith(t *testing.T, s *Server) {
+	t.Helper()
+	time.Sleep(20 * time.Millisecond)
+	conn, err := net.Dial("tcp", s.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.Write([]byte("PING\r\n"))
+	r := bufio.NewReader(conn)
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		if line == "PONG\r\n" {
+			return
+		}
+	}
+}
+
+func TestServerSpeaksNATS(t *testing.T) {
+	s := broker(t, "127.0.0.1:0")
+	defer s.Close()
+	conn, err := net.Dial("tcp", s.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+
+	expect := func(prefix string) {
+		t.Helper()
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		line, err := r.ReadString('\n')
+		if err != nil || !strings.HasPrefix(line, prefix) {
+			t.Fatalf("read %q, %v; want %q", line, err, prefix)
+		}
+	}
+	expect("INFO {")
+	fmt.Fprint(conn, "CONNECT {\"verbose\":false}\r\nSUB hub q1 7\r\nPING\r\n")
+	expect("PONG")
+	fmt.Fprint(conn, "PUB hub reply.to 5\r\nhello\r\n")
+	expect("MSG hub 7 5\r\n")
+	expect("hello\r\n")
+	fmt.Fprint(conn, "UNSUB 7\r\nPUB hub 3\r\nbye\r\nPING\r\n")
+	expect("PONG")
+	fmt.Fprint(conn, "NONSENSE\r\n")
+	expect("-ERR")
+}
+
+func TestClientReconnects(t *testing.T) {
+	s := broker(t, "127.0.0.1:0")
+	addr := s.Addr().String()
+
+	c, err := Dial(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	disconnected, reconnected := make(chan error, 1), make(chan struct{}, 1)
+	c.OnDisconnect = func(err error) { disconnected <- err }
+	c.OnReconnect = func() { reconnected <- struct{}{} }
+	var got recorder
+	c.Subscribe("hub", got.handle)
+	go c.Serve(context.Background())
+
+	s.Close()
+	select {
+	case <-disconnected:
+	case <-time.After(2 * time.Second):
+		t.Fatal("no disconnect")
+	}
+	if err := c.Publish("hub", []byte("lost")); err != ErrDisconnected {
+		t.Errorf("publish while down: %v", err)
+	}
+
+	s = broker(t, addr)
+	defer s.Close()
+	select {
+	case <-reconnected:
+	case <-time.After(3 * time.Second):
+		t.Fatal("no reconnect")
+	}
+	syncWith(t, s)
+	c.Publish("hub", []byte("back"))
+	if msgs := got.wait(t, 1); msgs[0] != "hub:back" {
+		t.Errorf("after reconnect got %v", msgs)
+	}
+	if st := c.Stats(); !st.Connected || st.Dropped != 1 {
+		t.Errorf("stats = %+v", st)
+	}
+}
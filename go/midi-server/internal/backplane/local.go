@@ -0,0 +1,84 @@
+package backplane
+
+import "sync"
+
+// localBuffer is how many messages a Local subscription holds before it
+// starts dropping them.
+const localBuffer = 1024
+
+// Local is an in-process backplane. Hubs in the same process that share a
+// Local see each other's traffic; on its own it lets a single instance run
+// with the backplane switched on.
+type Local struct {
+	mu        sync.Mutex
+	subs      map[string][]chan []byte
+	closed    bool
+	published uint64
+	received  uint64
+	dropped   uint64
+}
+
+func NewLocal() *Local {
+	return &Local{subs: make(map[string][]chan []byte)}
+}
+
+// Publish hands data to every subscriber of subject without waiting for
+// them; a subscriber that has fallen localBuffer messages behind misses it.
+func (l *Local) Publish(subject string, data []byte) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.closed {
+		return ErrClosed
+	}
+	l.published++
+	data = append([]byte(nil), data...)
+	for _, ch := range l.subs[subject] {
+		select {
+		case ch <- data:
+		default:
+			l.dropped++
+		}
+	}
+	return nil
+}
+
+func (l *Local) Subscribe(subject string, h Handler) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.closed {
+		return ErrClosed
+	}
+	ch := make(chan []byte, localBuffer)
+	l.subs[subject] = append(l.subs[subject], ch)
+	go func() {
+		for data := range ch {
+			h(subject, data)
+			l.mu.Lock()
+			l.received++
+			l.mu.Unlock()
+		}
+	}()
+	return nil
+}
+
+func (l *Local) Stats() Stats {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return Stats{Connected: !l.closed, Published: l.published, Received: l.received, Dropped: l.dropped}
+}
+
+// Close stops delivery. Messages already queued are still handled.
+func (l *Local) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.closed {
+		return nil
+	}
+	l.closed = true
+	for _, subs := range l.subs {
+		for _, ch := range subs {
+			close(ch)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,513 @@
+package backplane
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	maxPayload  = 1 << 20
+	sendBuffer  = 4096 // frames queued per connection
+	dialTimeout = 5 * time.Second
+	minBackoff  = 250 * time.Millisecond
+	maxBackoff  = 5 * time.Second
+)
+
+var (
+	serverInfo  = []byte(`INFO {"server_id":"midi-lab","proto":0,"max_payload":1048576}` + "\r\n")
+	connectLine = []byte(`CONNECT {"verbose":false,"pedantic":false,"name":"midi-server","lang":"go"}` + "\r\nPING\r\n")
+	pong        = []byte("PONG\r\n")
+)
+
+// Server is a minimal NATS-style broker. It handles CONNECT, PING/PONG,
+// SUB, UNSUB and PUB with exact subjects: no wildcards, and queue groups
+// are plain subscriptions. A subscriber that can't keep up is
+// disconnected, as NATS does with slow consumers.
+type Server struct {
+	ln net.Listener
+
+	mu     sync.Mutex
+	links  map[*link]map[string]string // subscriptions by sid
+	closed bool
+}
+
+// Listen opens a broker on addr. With port 0 a free port is chosen.
+func Listen(addr string) (*Server, error) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return &Server{ln: ln, links: make(map[*link]map[string]string)}, nil
+}
+
+// Addr returns the local address, useful when listening on port 0.
+func (s *Server) Addr() net.Addr {
+	return s.ln.Addr()
+}
+
+// Serve accepts connections until ctx is done or the server is closed.
+func (s *Server) Serve(ctx context.Context) error {
+	go func() {
+		<-ctx.Done()
+		s.Close()
+	}()
+	for {
+		conn, err := s.ln.Accept()
+		if err != nil {
+			if ctx.Err() != nil || errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+		go s.handle(conn)
+	}
+}
+
+func (s *Server) handle(conn net.Conn) {
+	l := newLink(conn, bufio.NewReader(conn))
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		l.close()
+		return
+	}
+	s.links[l] = make(map[string]string)
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		delete(s.links, l)
+		s.mu.Unlock()
+	}()
+
+	l.send(serverInfo)
+	for {
+		op, args, err := readOp(l.r)
+		if err != nil {
+			l.close()
+			return
+		}
+		switch op {
+		case "CONNECT", "PONG", "+OK", "":
+		case "PING":
+			l.send(pong)
+		case "SUB": // SUB <subject> [queue group] <sid>
+			if len(args) < 2 || len(args) > 3 {
+				l.send(errLine("Invalid Subject"))
+				continue
+			}
+			s.mu.Lock()
+			s.links[l][args[len(args)-1]] = args[0]
+			s.mu.Unlock()
+		case "UNSUB": // UNSUB <sid> [max msgs]
+			if len(args) > 0 {
+				s.mu.Lock()
+				delete(s.links[l], args[0])
+				s.mu.Unlock()
+			}
+		case "PUB": // PUB <subject> [reply-to] <size>
+			if len(args) < 2 || len(args) > 3 {
+				l.finish(errLine("Invalid Publish"))
+				return
+			}
+			data, err := readPayload(l.r, args[len(args)-1])
+			if err != nil {
+				l.finish(errLine(err.Error()))
+				return
+			}
+			s.route(args[0], data)
+		default:
+			l.finish(errLine("Unknown Protocol Operation"))
+			return
+		}
+	}
+}
+
+// route sends data to every subscription on subject.
+func (s *Server) route(subject string, data []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for l, subs := range s.links {
+		for sid, sub := range subs {
+			if sub == subject && !l.send(frame("MSG "+subject+" "+sid, data)) {
+				go l.close() // slow consumer
+			}
+		}
+	}
+}
+
+// Close stops accepting and disconnects everyone.
+func (s *Server) Close() error {
+	s.mu.Lock()
+	s.closed = true
+	for l := range s.links {
+		l.close()
+	}
+	s.mu.Unlock()
+	return s.ln.Close()
+}
+
+// Client connects an instance to a Server or a NATS server. When the
+// connection drops, Serve reconnects with backoff and subscribes again;
+// messages published in the meantime are dropped.
+type Client struct {
+	// OnDisconnect and OnReconnect, if set, are called from Serve when
+	// the connection drops and when it is back. Set them before Serve.
+	OnDisconnect func(err error)
+	OnReconnect  func()
+
+	addr string
+	done chan struct{}
+
+	mu        sync.Mutex
+	conn      *link // nil while reconnecting
+	subs      map[string]subscription
+	closed    bool
+	published uint64
+	received  uint64
+	dropped   uint64
+}
+
+type subscription struct {
+	subject string
+	handler Handler
+}
+
+// Dial connects to the broker at addr, given as host:port or
+// nats://host:port.
+func Dial(addr string) (*Client, error) {
+	addr = strings.TrimPrefix(strings.TrimPrefix(addr, "nats://"), "tcp://")
+	l, err := connect(addr)
+	if err != nil {
+		return nil, err
+	}
+	return &Client{addr: addr, done: make(chan struct{}), conn: l, subs: make(map[string]subscription)}, nil
+}
+
+// connect dials addr and completes the handshake: the server's INFO, our
+// CONNECT, and a PING answered by PONG.
+func connect(addr string) (*link, error) {
+	conn, err := net.DialTimeout("tcp", addr, dialTimeout)
+	if err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(time.Now().Add(dialTimeout))
+	r := bufio.NewReader(conn)
+	if op, _, err := readOp(r); err != nil || op != "INFO" {
+		conn.Close()
+		return nil, fmt.Errorf("backplane: %s is not a NATS server", addr)
+	}
+	if _, err := conn.Write(connectLine); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	for {
+		op, args, err := readOp(r)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		if op == "PONG" {
+			break
+		}
+		if op == "-ERR" {
+			conn.Close()
+			return nil, fmt.Errorf("backplane: server refused connection: %s", strings.Join(args, " "))
+		}
+	}
+	conn.SetDeadline(time.Time{})
+	return newLink(conn, r), nil
+}
+
+func (c *Client) Publish(subject string, data []byte) error {
+	if !validSubject(subject) {
+		return fmt.Errorf("backplane: invalid subject %q", subject)
+	}
+	if len(data) > maxPayload {
+		return fmt.Errorf("backplane: %d byte message is over the %d byte limit", len(data), maxPayload)
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	switch {
+	case c.closed:
+		return ErrClosed
+	case c.conn == nil:
+		c.dropped++
+		return ErrDisconnected
+	case !c.conn.send(frame("PUB "+subject, data)):
+		c.dropped++
+		return ErrFull
+	}
+	c.published++
+	return nil
+}
+
+func (c *Client) Subscribe(subject string, h Handler) error {
+	if !validSubject(subject) {
+		return fmt.Errorf("backplane: invalid subject %q", subject)
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return ErrClosed
+	}
+	sid := strconv.Itoa(len(c.subs) + 1)
+	c.subs[sid] = subscription{subject: subject, handler: h}
+	if c.conn != nil && !c.conn.send(subLine(subject, sid)) {
+		return ErrFull
+	}
+	return nil
+}
+
+// Serve handles incoming messages, reconnecting as needed, until ctx is
+// done or the client is closed.
+func (c *Client) Serve(ctx context.Context) error {
+	go func() {
+		select {
+		case <-ctx.Done():
+			c.Close()
+		case <-c.done:
+		}
+	}()
+	for {
+		c.mu.Lock()
+		l := c.conn
+		c.mu.Unlock()
+
+		err := c.read(l)
+		l.close()
+		c.mu.Lock()
+		c.conn = nil
+		closed := c.closed
+		c.mu.Unlock()
+		if closed {
+			return nil
+		}
+		if c.OnDisconnect != nil {
+			c.OnDisconnect(err)
+		}
+		if !c.reconnect() {
+			return nil
+		}
+		if c.OnReconnect != nil {
+			c.OnReconnect()
+		}
+	}
+}
+
+func (c *Client) read(l *link) error {
+	for {
+		op, args, err := readOp(l.r)
+		if err != nil {
+			return err
+		}
+		switch op {
+		case "MSG": // MSG <subject> <sid> [reply-to] <size>
+			if len(args) < 3 || len(args) > 4 {
+				return fmt.Errorf("backplane: malformed MSG %v", args)
+			}
+			data, err := readPayload(l.r, args[len(args)-1])
+			if err != nil {
+				return err
+			}
+			c.mu.Lock()
+			sub, ok := c.subs[args[1]]
+			if ok {
+				c.received++
+			}
+			c.mu.Unlock()
+			if ok {
+				sub.handler(args[0], data)
+			}
+		case "PING":
+			l.send(pong)
+		case "-ERR":
+			return fmt.Errorf("backplane: server error: %s", strings.Join(args, " "))
+		}
+	}
+}
+
+// reconnect dials until it succeeds, reporting false if the client is
+// closed first.
+func (c *Client) reconnect() bool {
+	backoff := minBackoff
+	for {
+		select {
+		case <-c.done:
+			return false
+		case <-time.After(backoff):
+		}
+		l, err := connect(c.addr)
+		if err != nil {
+			if backoff *= 2; backoff > maxBackoff {
+				backoff = maxBackoff
+			}
+			continue
+		}
+		c.mu.Lock()
+		if c.closed {
+			c.mu.Unlock()
+			l.close()
+			return false
+		}
+		for sid, sub := range c.subs {
+			l.send(subLine(sub.subject, sid))
+		}
+		c.conn = l
+		c.mu.Unlock()
+		return true
+	}
+}
+
+func (c *Client) Stats() Stats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return Stats{Connected: c.conn != nil, Published: c.published, Received: c.received, Dropped: c.dropped}
+}
+
+func (c *Client) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return nil
+	}
+	c.closed = true
+	close(c.done)
+	if c.conn != nil {
+		c.conn.close()
+	}
+	return nil
+}
+
+// link is one end of a connection. Outgoing frames are buffered so
+// publishers never wait on the network.
+type link struct {
+	conn net.Conn
+	r    *bufio.Reader
+	out  chan []byte
+	done chan struct{}
+	once sync.Once
+}
+
+func newLink(conn net.Conn, r *bufio.Reader) *link {
+	l := &link{conn: conn, r: r, out: make(chan []byte, sendBuffer), done: make(chan struct{})}
+	go l.write()
+	return l
+}
+
+// send queues a frame, reporting false if the buffer is full or the link
+// closed.
+func (l *link) send(frame []byte) bool {
+	select {
+	case <-l.done:
+		return false
+	default:
+	}
+	select {
+	case l.out <- frame:
+		return true
+	default:
+		return false
+	}
+}
+
+// finish sends a last frame and closes the link once everything queued
+// before it has been written.
+func (l *link) finish(frame []byte) {
+	if !l.send(frame) || !l.send(nil) {
+		l.close()
+	}
+}
+
+func (l *link) write() {
+	w := bufio.NewWriter(l.conn)
+	for {
+		select {
+		case f := <-l.out:
+			last := f == nil
+			w.Write(f)
+			for !last && len(l.out) > 0 {
+				f = <-l.out
+				last = f == nil
+				w.Write(f)
+			}
+			if err := w.Flush(); err != nil || last {
+				l.close()
+				return
+			}
+		case <-l.done:
+			return
+		}
+	}
+}
+
+func (l *link) close() {
+	l.once.Do(func() {
+		close(l.done)
+		l.conn.Close()
+	})
+}
+
+// readOp reads one protocol line, returning the upper-cased operation and
+// its arguments.
+func readOp(r *bufio.Reader) (op string, args []string, err error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return "", nil, err
+	}
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		return "", nil, nil
+	}
+	return strings.ToUpper(fields[0]), fields[1:], nil
+}
+
+// readPayload reads a message body of the given size and its trailing
+// CRLF.
+func readPayload(r *bufio.Reader, size string) ([]byte, error) {
+	n, err := strconv.Atoi(size)
+	if err != nil || n < 0 {
+		return nil, fmt.Errorf("backplane: invalid payload size %q", size)
+	}
+	if n > maxPayload {
+		return nil, errors.New("Maximum Payload Violation")
+	}
+	buf := make([]byte, n+2)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return nil, err
+	}
+	if string(buf[n:]) != "\r\n" {
+		return nil, errors.New("backplane: payload not terminated by CRLF")
+	}
+	return buf[:n], nil
+}
+
+// frame builds a "PUB subject" or "MSG subject sid" line with its payload.
+func frame(head string, data []byte) []byte {
+	b := make([]byte, 0, len(head)+len(data)+16)
+	b = append(b, head...)
+	b = append(b, ' ')
+	b = strconv.AppendInt(b, int64(len(data)), 10)
+	b = append(b, "\r\n"...)
+	b = append(b, data...)
+	return append(b, "\r\n"...)
+}
+
+func subLine(subject, sid string) []byte {
+	return []byte("SUB " + subject + " " + sid + "\r\n")
+}
+
+func errLine(msg string) []byte {
+	return []byte("-ERR '" + msg + "'\r\n")
+}
+
+func validSubject(s string) bool {
+	return s != "" && !strings.ContainsAny(s, " \t\r\n")
+}
@@ -0,0 +1,183 @@
+package broadcast
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Mode is how AdaptiveBroadcaster is currently delivering.
+type Mode string
+
+const (
+	ModeImmediate Mode = "immediate" // as DefaultBroadcaster
+	ModeBuffered  Mode = "buffered"  // as BufferedBroadcaster
+	ModeLossy     Mode = "lossy"     // as LossyBroadcaster
+)
+
+// Defaults for AdaptiveBroadcaster's zero-valued settings.
+const (
+	DefaultBufferedLag = 0.25
+	DefaultLossyLag    = 0.75
+	DefaultLossyFanOut = 5 * time.Millisecond
+	DefaultHold        = 2 * time.Second
+	DefaultHistory     = 20
+)
+
+// smoothing weighs each broadcast's measurements into the running averages.
+const smoothing = 0.1
+
+// Switch records one change of mode.
+type Switch struct {
+	At     time.Time `json:"at"`
+	From   Mode      `json:"from"`
+	To     Mode      `json:"to"`
+	Reason string    `json:"reason"`
+}
+
+// AdaptiveStats is what AdaptiveBroadcaster reports about itself.
+type AdaptiveStats struct {
+	Mode     Mode     `json:"mode"`
+	Lag      float64  `json:"lag"`        // average queue fill, 0 to 1
+	FanOut   float64  `json:"fan_out_ms"` // average time to fan a message out
+	Switches []Switch `json:"switches"`   // most recent last
+}
+
+// AdaptiveBroadcaster watches how full client queues are and how long
+// each fan-out takes, and moves between immediate, buffered and lossy
+// delivery to suit: buffered once clients start lagging, lossy when they
+// are far behind or fan-out itself gets expensive, and back again as
+// things recover. Both measures are smoothed, and it holds each mode for
+// at least Hold, so it doesn't flap.
+type AdaptiveBroadcaster struct {
+	Registry
+
+	BufferedLag float64       // average queue fill that switches to buffered
+	LossyLag    float64       // average queue fill that switches to lossy
+	LossyFanOut time.Duration // fan-out time that switches to lossy
+	Hold        time.Duration // minimum time between switches
+	History     int           // switches kept for Stats
+
+	// OnSwitch, if set, is called after every change of mode.
+	OnSwitch func(Switch)
+
+	mu       sync.Mutex
+	mode     Mode
+	lag      float64
+	fanOut   time.Duration
+	switched time.Time
+	history  []Switch
+}
+
+func (b *AdaptiveBroadcaster) Broadcast(message interface{}) {
+	start := time.Now()
+	mode := b.Mode()
+	critical := PriorityOf(message) == Critical
+
+	list := b.Snapshot()
+	var fill float64
+	for _, r := range list {
+		q := r.Client.SendQueue()
+		fill += float64(q.Len()) / float64(q.Cap())
+		switch mode {
+		case ModeBuffered:
+			deliverBuffered(r.Client, message)
+		case ModeLossy:
+			deliverLossy(r.Client, message, critical)
+		default:
+			deliver(r.Client, message)
+		}
+	}
+	if len(list) > 0 {
+		fill /= float64(len(list))
+	}
+	b.observe(fill, time.Since(start), start)
+}
+
+// observe folds in one broadcast's measurements and switches mode if
+// they call for it.
+func (b *AdaptiveBroadcaster) observe(fill float64, cost time.Duration, now time.Time) {
+	b.mu.Lock()
+	b.lag += smoothing * (fill - b.lag)
+	b.fanOut += time.Duration(smoothing * float64(cost-b.fanOut))
+
+	target := ModeImmediate
+	switch {
+	case b.lag >= orDefault(b.LossyLag, DefaultLossyLag) || b.fanOut >= orDefaultDuration(b.LossyFanOut, DefaultLossyFanOut):
+		target = ModeLossy
+	case b.lag >= orDefault(b.BufferedLag, DefaultBufferedLag):
+		target = ModeBuffered
+	}
+	from := b.current()
+	if target == from || now.Sub(b.switched) < orDefaultDuration(b.Hold, DefaultHold) {
+		b.mu.Unlock()
+		return
+	}
+
+	s := Switch{
+		At:     now,
+		From:   from,
+		To:     target,
+		Reason: fmt.Sprintf("lag %.2f, fan-out %v", b.lag, b.fanOut.Round(time.Microsecond)),
+	}
+	b.mode = target
+	b.switched = now
+	b.history = append(b.history, s)
+	if max := b.maxHistory(); len(b.history) > max {
+		b.history = b.history[len(b.history)-max:]
+	}
+	onSwitch := b.OnSwitch
+	b.mu.Unlock()
+
+	if onSwitch != nil {
+		onSwitch(s)
+	}
+}
+
+// Mode returns the current delivery mode.
+func (b *AdaptiveBroadcaster) Mode() Mode {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.current()
+}
+
+func (b *AdaptiveBroadcaster) current() Mode {
+	if b.mode == "" {
+		return ModeImmediate
+	}
+	return b.mode
+}
+
+func (b *AdaptiveBroadcaster) maxHistory() int {
+	if b.History > 0 {
+		return b.History
+	}
+	return DefaultHistory
+}
+
+// Stats returns the current mode, the smoothed measurements and recent
+// switches.
+func (b *AdaptiveBroadcaster) Stats() AdaptiveStats {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return AdaptiveStats{
+		Mode:     b.current(),
+		Lag:      b.lag,
+		FanOut:   float64(b.fanOut) / float64(time.Millisecond),
+		Switches: append([]Switch(nil), b.history...),
+	}
+}
+
+func orDefault(v, def float64) float64 {
+	if v > 0 {
+		return v
+	}
+	return def
+}
+
+func orDefaultDuration(v, def time.Duration) time.Duration {
+	if v > 0 {
+		return v
+	}
+	return def
+}
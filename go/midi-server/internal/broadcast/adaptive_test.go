@@ -0,0 +1,95 @@
+package broadcast
+
+import (
+	"testing"
+	"time"
+)
+
+func TestAdaptiveFollowsLag(t *testing.T) {
+	var switches []Switch
+	b := &AdaptiveBroadcaster{
+		Hold:        time.Nanosecond,
+		LossyFanOut: time.Hour, // only lag matters here
+		OnSwitch:    func(s Switch) { switches = append(switches, s) },
+	}
+	list := register(b, 4, 4)
+
+	// Nobody reads, so queues fill and stay full.
+	for i := 0; i < 40 && b.Mode() != ModeLossy; i++ {
+		b.Broadcast(flash(i))
+	}
+	if b.Mode() != ModeLossy {
+		t.Fatalf("mode = %s with full queues, want lossy (lag %.2f)", b.Mode(), b.Stats().Lag)
+	}
+
+	// Clients catch up: every queue is empty before each broadcast.
+	for i := 0; i < 100 && b.Mode() != ModeImmediate; i++ {
+		for _, c := range list {
+			for c.queue.Len() > 0 {
+				c.queue.Pop()
+			}
+		}
+		b.Broadcast(flash(i))
+	}
+	if b.Mode() != ModeImmediate {
+		t.Fatalf("mode = %s after recovery, want immediate (lag %.2f)", b.Mode(), b.Stats().Lag)
+	}
+
+	want := []Mode{ModeImmediate, ModeBuffered, ModeLossy, ModeBuffered, ModeImmediate}
+	stats := b.Stats()
+	if len(stats.Switches) != len(want)-1 || len(switches) != len(want)-1 {
+		t.Fatalf("switches = %+v", stats.Switches)
+	}
+	for i, s := range stats.Switches {
+		if s.From != want[i] || s.To != want[i+1] || s.Reason == "" {
+			t.Errorf("switch %d = %+v, want %s -> %s", i, s, want[i], want[i+1])
+		}
+		if s != switches[i] {
+			t.Errorf("OnSwitch saw %+v, stats have %+v", switches[i], s)
+		}
+	}
+}
+
+func TestAdaptiveGoesLossyOnSlowFanOut(t *testing.T) {
+	b := &AdaptiveBroadcaster{Hold: time.Nanosecond, LossyFanOut: time.Nanosecond}
+	register(b, 100, 64)
+	for i := 0; i < 50 && b.Mode() != ModeLossy; i++ {
+		b.Broadcast(flash(i))
+	}
+	if b.Mode() != ModeLossy {
+		t.Errorf("mode = %s, want lossy when fan-out exceeds its limit", b.Mode())
+	}
+}
+
+func TestAdaptiveHold(t *testing.T) {
+	b := &AdaptiveBroadcaster{Hold: time.Hour, LossyFanOut: time.Hour}
+	register(b, 2, 2)
+	for i := 0; i < 100; i++ {
+		b.Broadcast(flash(i))
+	}
+	// The first switch is allowed; the next must wait out the hold.
+	if s := b.Stats(); len(s.Switches) != 1 || s.Mode != ModeBuffered {
+		t.Errorf("got mode %s after %d switches, want one switch to buffered", s.Mode, len(s.Switches))
+	}
+}
+
+func TestAdaptiveHistoryIsBounded(t *testing.T) {
+	b := &AdaptiveBroadcaster{History: 2}
+	now := time.Now()
+	// Alternate long stretches of full and empty queues.
+	for i := 0; i < 200; i++ {
+		fill := 0.0
+		if i/40%2 == 0 {
+			fill = 1
+		}
+		now = now.Add(time.Hour)
+		b.observe(fill, 0, now)
+	}
+	s := b.Stats()
+	if len(s.Switches) != 2 {
+		t.Fatalf("kept %d switches, want 2", len(s.Switches))
+	}
+	if last := s.Switches[1]; last.To != s.Mode {
+		t.Errorf("last kept switch %+v doesn't end in mode %s", last, s.Mode)
+	}
+}
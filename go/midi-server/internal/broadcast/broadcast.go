@@ -1,77 +1,113 @@
+// Package broadcast fans hub messages out to connected clients. Clients
+// register with a Broadcaster under an ID and receive messages through
+// their own Queue; nothing here depends on the transport, so the same
+// broadcasters serve WebSocket clients or any other kind.
 package broadcast
 
 import (
 	"sync"
 	"time"
-
-	"github.com/gorilla/websocket"
 )
 
+// ClientSender is a client the broadcasters can deliver to. Messages go
+// into its Queue; Close disconnects it.
 type ClientSender interface {
-	SendChannel() chan interface{}
+	SendQueue() *Queue
 	Close()
 }
 
+// Broadcaster delivers each message to every registered client. Add and
+// Remove may be called concurrently with Broadcast.
 type Broadcaster interface {
-	Broadcast(clients map[*websocket.Conn]ClientSender, message interface{})
+	Add(id string, c ClientSender)
+	Remove(id string)
+	Snapshot() []Registration
+	Broadcast(message interface{})
 }
 
-type DefaultBroadcaster struct{}
+// bufferedGrace is how long BufferedBroadcaster lets a full queue drain.
+const bufferedGrace = 50 * time.Millisecond
 
-func (b *DefaultBroadcaster) Broadcast(clients map[*websocket.Conn]ClientSender, message interface{}) {
-	for _, client := range clients {
-		select {
-		case client.SendChannel() <- message:
-		default:
-			client.Close()
-		}
+// deliver queues message for c, closing c if its queue refuses.
+func deliver(c ClientSender, message interface{}) {
+	if !c.SendQueue().Push(message) {
+		c.Close()
 	}
 }
 
-type BufferedBroadcaster struct{}
+// deliverBuffered delivers at once if c's queue has room, and otherwise
+// after waiting up to bufferedGrace for some.
+func deliverBuffered(c ClientSender, message interface{}) {
+	q := c.SendQueue()
+	if q.Len() < q.Cap() {
+		deliver(c, message)
+		return
+	}
+	go func() {
+		q.WaitRoom(bufferedGrace)
+		deliver(c, message)
+	}()
+}
 
-func (b *BufferedBroadcaster) Broadcast(clients map[*websocket.Conn]ClientSender, message interface{}) {
-	for _, client := range clients {
-		select {
-		case client.SendChannel() <- message:
-		default:
-			go func(c ClientSender) {
-				select {
-				case c.SendChannel() <- message:
-				case <-time.After(50 * time.Millisecond):
-					c.Close()
-				}
-			}(client)
-		}
+// deliverLossy skips c if its queue is full, unless message is critical.
+func deliverLossy(c ClientSender, message interface{}, critical bool) {
+	if critical {
+		deliver(c, message)
+		return
 	}
+	// Skip slow clients but don't close them
+	c.SendQueue().Offer(message)
+}
+
+// DefaultBroadcaster queues to every client, leaving overflow to each
+// queue's policy; clients are only closed under the Disconnect policy.
+type DefaultBroadcaster struct {
+	Registry
 }
 
-type BatchBroadcaster struct{}
+func (b *DefaultBroadcaster) Broadcast(message interface{}) {
+	for _, r := range b.Snapshot() {
+		deliver(r.Client, message)
+	}
+}
 
-func (b *BatchBroadcaster) Broadcast(clients map[*websocket.Conn]ClientSender, message interface{}) {
+// BufferedBroadcaster gives a full queue 50ms to drain before falling
+// back to its overflow policy.
+type BufferedBroadcaster struct {
+	Registry
+}
+
+func (b *BufferedBroadcaster) Broadcast(message interface{}) {
+	for _, r := range b.Snapshot() {
+		deliverBuffered(r.Client, message)
+	}
+}
+
+type BatchBroadcaster struct {
+	Registry
+}
+
+func (b *BatchBroadcaster) Broadcast(message interface{}) {
 	var wg sync.WaitGroup
-	for _, client := range clients {
+	for _, r := range b.Snapshot() {
 		wg.Add(1)
 		go func(c ClientSender) {
 			defer wg.Done()
-			select {
-			case c.SendChannel() <- message:
-			default:
-				c.Close()
-			}
-		}(client)
+			deliver(c, message)
+		}(r.Client)
 	}
 	wg.Wait()
 }
 
-type LossyBroadcaster struct{}
+// LossyBroadcaster skips clients whose queue is full, whatever its policy,
+// unless the message is Critical.
+type LossyBroadcaster struct {
+	Registry
+}
 
-func (b *LossyBroadcaster) Broadcast(clients map[*websocket.Conn]ClientSender, message interface{}) {
-	for _, client := range clients {
-		select {
-		case client.SendChannel() <- message:
-		default:
-			// Skip slow clients but don't close them
-		}
+func (b *LossyBroadcaster) Broadcast(message interface{}) {
+	critical := PriorityOf(message) == Critical
+	for _, r := range b.Snapshot() {
+		deliverLossy(r.Client, message, critical)
 	}
 }
@@ -0,0 +1,212 @@
+package broadcast
+
+import (
+	"fmt"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// strategies are the broadcasters under test, freshly built for each case.
+// CoalescingBroadcaster delivers through one of these and has its own
+// tests.
+var strategies = []struct {
+	name string
+	new  func() Broadcaster
+}{
+	{"default", func() Broadcaster { return &DefaultBroadcaster{} }},
+	{"buffered", func() Broadcaster { return &BufferedBroadcaster{} }},
+	{"batch", func() Broadcaster { return &BatchBroadcaster{} }},
+	{"lossy", func() Broadcaster { return &LossyBroadcaster{} }},
+	{"sharded", func() Broadcaster { return &ShardedBroadcaster{Workers: 2} }},
+}
+
+func stop(b Broadcaster) {
+	if s, ok := b.(*ShardedBroadcaster); ok {
+		s.Stop()
+	}
+}
+
+func TestStrategyCloseAndDrop(t *testing.T) {
+	// Each client gets 10 note flashes with a queue of 4.
+	type want struct {
+		closed  bool
+		dropped uint64
+		kept    []interface{} // queued messages for a stalled client, if deterministic
+	}
+	tests := []struct {
+		name   string
+		client fakeOptions
+		want   map[string]want // by strategy; "" is the default
+	}{
+		{
+			name:   "fast client",
+			client: fakeOptions{depth: 16},
+			want:   map[string]want{"": {}},
+		},
+		{
+			name:   "stalled, drop-oldest",
+			client: fakeOptions{depth: 4, stalled: true},
+			want: map[string]want{
+				"":         {dropped: 6, kept: []interface{}{flash(6), flash(7), flash(8), flash(9)}},
+				"buffered": {dropped: 6}, // late pushes race each other
+				"lossy":    {dropped: 6, kept: []interface{}{flash(0), flash(1), flash(2), flash(3)}},
+			},
+		},
+		{
+			name:   "stalled, drop-newest",
+			client: fakeOptions{depth: 4, policy: DropNewest, stalled: true},
+			want: map[string]want{
+				"":         {dropped: 6, kept: []interface{}{flash(0), flash(1), flash(2), flash(3)}},
+				"buffered": {dropped: 6},
+			},
+		},
+		{
+			name:   "stalled, disconnect",
+			client: fakeOptions{depth: 4, policy: Disconnect, stalled: true},
+			want: map[string]want{
+				// Once closed, the queue refuses without counting.
+				"":      {closed: true, dropped: 1},
+				"lossy": {dropped: 6}, // skips rather than closes
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		for _, s := range strategies {
+			w, ok := tt.want[s.name]
+			if !ok {
+				w = tt.want[""]
+			}
+			t.Run(tt.name+"/"+s.name, func(t *testing.T) {
+				b := s.new()
+				defer stop(b)
+				clients := make([]*fakeClient, 3)
+				for i := range clients {
+					clients[i] = newFake(tt.client)
+					b.Add(fmt.Sprint(i), clients[i])
+				}
+				for i := 0; i < 10; i++ {
+					b.Broadcast(flash(i))
+				}
+
+				for i, c := range clients {
+					// Buffered gives full queues 50ms before giving up.
+					if !eventually(func() bool { return c.queue.Dropped() >= w.dropped }) {
+						t.Errorf("client %d: dropped %d, want %d", i, c.queue.Dropped(), w.dropped)
+					}
+					if !eventually(func() bool { return c.closed() == w.closed }) {
+						t.Errorf("client %d: closed = %v, want %v", i, c.closed(), w.closed)
+					}
+					if w.kept != nil {
+						msgs, _ := drain(c.queue)
+						if fmt.Sprint(msgs) != fmt.Sprint(w.kept) {
+							t.Errorf("client %d kept %v, want %v", i, msgs, w.kept)
+						}
+					}
+					c.finish()
+					if got := c.queue.Dropped(); got != w.dropped {
+						t.Errorf("client %d: dropped %d in the end, want %d", i, got, w.dropped)
+					}
+					if !w.closed && atomic.LoadInt64(&c.delivered)+int64(c.queue.Dropped()) != 10 && w.kept == nil {
+						t.Errorf("client %d: delivered %d + dropped %d != 10", i, c.delivered, c.queue.Dropped())
+					}
+				}
+			})
+		}
+	}
+}
+
+func TestStrategiesKeepCritical(t *testing.T) {
+	for _, s := range strategies {
+		t.Run(s.name, func(t *testing.T) {
+			b := s.new()
+			defer stop(b)
+			c := newFake(fakeOptions{depth: 2, stalled: true})
+			b.Add("c", c)
+			for i := 0; i < 5; i++ {
+				b.Broadcast(flash(i))
+			}
+			b.Broadcast(cue("chorus"))
+
+			// Buffered may queue a late flash after the cue, but a flash
+			// can never evict it.
+			if !eventually(func() bool {
+				msgs, _ := peek(c.queue)
+				return len(msgs) == 2 && (msgs[0] == cue("chorus") || msgs[1] == cue("chorus"))
+			}) {
+				msgs, _ := peek(c.queue)
+				t.Errorf("queue = %v, want the cue kept", msgs)
+			}
+			if c.closed() || c.queue.TakeResync() {
+				t.Error("a critical message that fits should neither close nor resync")
+			}
+			c.finish()
+		})
+	}
+}
+
+// peek returns the queued messages without consuming them.
+func peek(q *Queue) ([]interface{}, []uint64) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	var msgs []interface{}
+	var seqs []uint64
+	for i := 0; i < q.size; i++ {
+		e := q.buf[(q.head+i)%len(q.buf)]
+		msgs = append(msgs, e.msg)
+		seqs = append(seqs, e.seq)
+	}
+	return msgs, seqs
+}
+
+// BenchmarkStrategyOutcomes broadcasts to an audience where most phones
+// keep up, some are slow and a few have stalled, and reports what share of
+// messages were delivered and dropped and what share of clients were
+// closed.
+func BenchmarkStrategyOutcomes(b *testing.B) {
+	const audience = 500
+	for _, policy := range []Policy{DropOldest, Disconnect} {
+		for _, s := range strategies {
+			b.Run(fmt.Sprintf("%s/%s", policy, s.name), func(b *testing.B) {
+				br := s.new()
+				defer stop(br)
+				clients := make([]*fakeClient, audience)
+				for i := range clients {
+					o := fakeOptions{depth: 16, policy: policy}
+					switch {
+					case i%50 == 0:
+						o.stalled = true
+					case i%10 == 0:
+						o.latency = 200 * time.Microsecond
+					}
+					clients[i] = newFake(o)
+					br.Add(fmt.Sprint(i), clients[i])
+				}
+
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					br.Broadcast(flash(i))
+				}
+				b.StopTimer()
+
+				// Let buffered's grace periods run out before counting.
+				time.Sleep(60 * time.Millisecond)
+				var delivered, dropped, closed int64
+				for _, c := range clients {
+					closedByBroadcaster := c.closed()
+					c.finish()
+					delivered += atomic.LoadInt64(&c.delivered)
+					dropped += int64(c.queue.Dropped())
+					if closedByBroadcaster {
+						closed++
+					}
+				}
+				sent := float64(b.N) * audience
+				b.ReportMetric(float64(delivered)/sent, "delivered")
+				b.ReportMetric(float64(dropped)/sent, "dropped")
+				b.ReportMetric(float64(closed)/audience, "closed")
+			})
+		}
+	}
+}
@@ -0,0 +1,84 @@
+package broadcast
+
+import (
+	"sync"
+	"time"
+)
+
+// DefaultCoalesceWindow is how long CoalescingBroadcaster holds messages
+// when no Window is set.
+const DefaultCoalesceWindow = 15 * time.Millisecond
+
+// Batch is several messages delivered to a client as one frame.
+type Batch []interface{}
+
+// Messages returns the batched messages in the order they were broadcast.
+func (b Batch) Messages() []interface{} {
+	return b
+}
+
+// Priority is Critical if any message in the batch is.
+func (b Batch) Priority() Priority {
+	for _, msg := range b {
+		if PriorityOf(msg) == Critical {
+			return Critical
+		}
+	}
+	return Ephemeral
+}
+
+// CoalescingBroadcaster holds messages for Window after the first one
+// arrives and then hands them to Next as a single Batch, so a burst of
+// notes costs each client one frame instead of dozens. A lone message is
+// passed on unwrapped. Clients are registered with Next.
+type CoalescingBroadcaster struct {
+	Window time.Duration
+	Next   Broadcaster // delivers each batch; a DefaultBroadcaster if nil
+
+	once    sync.Once
+	mu      sync.Mutex
+	pending Batch
+}
+
+func (b *CoalescingBroadcaster) next() Broadcaster {
+	b.once.Do(func() {
+		if b.Next == nil {
+			b.Next = &DefaultBroadcaster{}
+		}
+	})
+	return b.Next
+}
+
+func (b *CoalescingBroadcaster) Add(id string, c ClientSender) { b.next().Add(id, c) }
+func (b *CoalescingBroadcaster) Remove(id string)              { b.next().Remove(id) }
+func (b *CoalescingBroadcaster) Snapshot() []Registration      { return b.next().Snapshot() }
+
+func (b *CoalescingBroadcaster) Broadcast(message interface{}) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	// The batch goes to whoever is registered when the window closes.
+	b.pending = append(b.pending, message)
+	if len(b.pending) == 1 {
+		window := b.Window
+		if window <= 0 {
+			window = DefaultCoalesceWindow
+		}
+		time.AfterFunc(window, b.Flush)
+	}
+}
+
+// Flush delivers anything pending now.
+func (b *CoalescingBroadcaster) Flush() {
+	b.mu.Lock()
+	batch := b.pending
+	b.pending = nil
+	b.mu.Unlock()
+
+	switch len(batch) {
+	case 0:
+	case 1:
+		b.next().Broadcast(batch[0])
+	default:
+		b.next().Broadcast(batch)
+	}
+}
@@ -0,0 +1,143 @@
+package broadcast
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+type testClient struct {
+	queue  *Queue
+	closed bool
+}
+
+func (c *testClient) SendQueue() *Queue { return c.queue }
+func (c *testClient) Close()            { c.closed = true }
+
+// register adds n clients with queues of the given depth to b.
+func register(b Broadcaster, n, depth int) []*testClient {
+	list := make([]*testClient, n)
+	for i := range list {
+		list[i] = &testClient{queue: NewQueue(depth, DropOldest)}
+		b.Add(fmt.Sprintf("client-%d", i), list[i])
+	}
+	return list
+}
+
+// frames drains a client's queue, returning one entry per frame it would
+// have written and the total number of messages inside them.
+func frames(c *testClient) (frames, messages int) {
+	q := c.queue
+	for q.Len() > 0 {
+		msg, _, _ := q.Pop()
+		frames++
+		if b, ok := msg.(Batch); ok {
+			messages += len(b)
+		} else {
+			messages++
+		}
+	}
+	return frames, messages
+}
+
+func TestCoalescingBurstIsOneFramePerClient(t *testing.T) {
+	b := &CoalescingBroadcaster{Window: 20 * time.Millisecond}
+	list := register(b, 10, 64)
+
+	const burst = 40
+	for i := 0; i < burst; i++ {
+		b.Broadcast(fmt.Sprintf("note %d", i))
+	}
+	time.Sleep(3 * b.Window)
+
+	for i, c := range list {
+		f, m := frames(c)
+		if f != 1 || m != burst {
+			t.Errorf("client %d: %d frames carrying %d messages, want 1 carrying %d", i, f, m, burst)
+		}
+	}
+	t.Logf("%d messages -> 1 frame per client", burst)
+}
+
+func TestCoalescingKeepsOrder(t *testing.T) {
+	b := &CoalescingBroadcaster{Window: 10 * time.Millisecond}
+	list := register(b, 1, 8)
+	for i := 0; i < 5; i++ {
+		b.Broadcast(i)
+	}
+	b.Flush()
+
+	msg, _, _ := list[0].queue.Pop()
+	batch, ok := msg.(Batch)
+	if !ok || len(batch) != 5 {
+		t.Fatalf("got %#v, want a batch of 5", msg)
+	}
+	for i, m := range batch.Messages() {
+		if m != i {
+			t.Errorf("batch[%d] = %v", i, m)
+		}
+	}
+}
+
+func TestCoalescingSpacedMessages(t *testing.T) {
+	b := &CoalescingBroadcaster{Window: 5 * time.Millisecond}
+	list := register(b, 3, 64)
+
+	// Messages further apart than the window aren't batched, and a lone
+	// message goes out as itself.
+	for i := 0; i < 4; i++ {
+		b.Broadcast(i)
+		time.Sleep(4 * b.Window)
+	}
+
+	for i, c := range list {
+		if c.queue.Len() != 4 {
+			t.Fatalf("client %d: %d frames, want 4", i, c.queue.Len())
+		}
+		for j := 0; j < 4; j++ {
+			if msg, _, _ := c.queue.Pop(); msg != j {
+				t.Errorf("client %d frame %d = %#v, want %d unwrapped", i, j, msg, j)
+			}
+		}
+	}
+}
+
+func TestCoalescingFramesPerClient(t *testing.T) {
+	// Bursts of notes 1ms apart, with a pause between bursts: roughly what
+	// an audience mashing pads looks like.
+	tests := []struct {
+		window     time.Duration
+		bursts     int
+		perBurst   int
+		wantFrames int
+	}{
+		{10 * time.Millisecond, 3, 8, 3},
+		{20 * time.Millisecond, 2, 12, 2},
+	}
+	for _, tt := range tests {
+		b := &CoalescingBroadcaster{Window: tt.window}
+		list := register(b, 5, 64)
+		for i := 0; i < tt.bursts; i++ {
+			for j := 0; j < tt.perBurst; j++ {
+				b.Broadcast(j)
+				time.Sleep(time.Millisecond / 4)
+			}
+			time.Sleep(3 * tt.window)
+		}
+
+		for i, c := range list {
+			f, m := frames(c)
+			if m != tt.bursts*tt.perBurst {
+				t.Errorf("window %v: client got %d messages, want %d", tt.window, m, tt.bursts*tt.perBurst)
+			}
+			// Timing on a loaded machine can split a burst; anything near
+			// one frame per burst is fine.
+			if f < tt.wantFrames || f > 2*tt.wantFrames {
+				t.Errorf("window %v: %d frames per client, want about %d", tt.window, f, tt.wantFrames)
+			}
+			if i == 0 {
+				t.Logf("window %v: %d messages in %d frames per client", tt.window, m, f)
+			}
+		}
+	}
+}
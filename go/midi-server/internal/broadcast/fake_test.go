@@ -0,0 +1,94 @@
+package broadcast
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// fakeClient is a ClientSender with a reader that drains its queue like a
+// connection's writer would, only as fast (or slow) as configured.
+type fakeClient struct {
+	queue     *Queue
+	latency   time.Duration // time to "write" each message
+	delivered int64         // messages the reader took
+	closes    int64         // calls to Close
+
+	resume  chan struct{} // closed to let a stalled reader start
+	stopped chan struct{} // closed when the reader exits
+	once    sync.Once
+}
+
+type fakeOptions struct {
+	depth   int
+	policy  Policy
+	latency time.Duration
+	stalled bool // the reader doesn't start until resumed
+}
+
+func newFake(o fakeOptions) *fakeClient {
+	if o.policy == "" {
+		o.policy = DropOldest
+	}
+	f := &fakeClient{
+		queue:   NewQueue(o.depth, o.policy),
+		latency: o.latency,
+		resume:  make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+	if !o.stalled {
+		close(f.resume)
+	}
+	go f.read()
+	return f
+}
+
+func (f *fakeClient) read() {
+	defer close(f.stopped)
+	<-f.resume
+	for {
+		if _, _, ok := f.queue.Pop(); !ok {
+			return
+		}
+		atomic.AddInt64(&f.delivered, 1)
+		if f.latency > 0 {
+			time.Sleep(f.latency)
+		}
+	}
+}
+
+func (f *fakeClient) SendQueue() *Queue { return f.queue }
+
+// Close disconnects the client: its queue refuses further messages and
+// the reader stops after what is already queued.
+func (f *fakeClient) Close() {
+	atomic.AddInt64(&f.closes, 1)
+	f.queue.Close()
+}
+
+func (f *fakeClient) closed() bool { return atomic.LoadInt64(&f.closes) > 0 }
+
+// finish unstalls the reader and waits for it to drain the queue.
+func (f *fakeClient) finish() {
+	f.once.Do(func() {
+		select {
+		case <-f.resume:
+		default:
+			close(f.resume)
+		}
+	})
+	f.queue.Close()
+	<-f.stopped
+}
+
+// eventually polls cond for up to a second.
+func eventually(cond func() bool) bool {
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		if cond() {
+			return true
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	return cond()
+}
@@ -0,0 +1,328 @@
+package broadcast
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Policy decides what a full Queue does with a new message.
+type Policy string
+
+const (
+	// DropOldest evicts the oldest queued message to make room.
+	DropOldest Policy = "drop-oldest"
+	// DropNewest discards the new message.
+	DropNewest Policy = "drop-newest"
+	// Coalesce replaces a queued message with the same CoalesceKey, or
+	// falls back to DropOldest when there is none.
+	Coalesce Policy = "coalesce"
+	// Disconnect refuses the message; the caller should close the client.
+	Disconnect Policy = "disconnect"
+)
+
+func ParsePolicy(s string) (Policy, error) {
+	switch p := Policy(s); p {
+	case DropOldest, DropNewest, Coalesce, Disconnect:
+		return p, nil
+	}
+	return "", fmt.Errorf("unknown overflow policy %q", s)
+}
+
+// Coalescer is implemented by messages where only the latest of a kind
+// matters, such as the current scene or beat.
+type Coalescer interface {
+	CoalesceKey() string
+}
+
+// Priority says whether a message may be dropped when a client falls
+// behind.
+type Priority int
+
+const (
+	// Critical messages, such as scene changes, are never dropped to make
+	// room for others. If one can't be queued at all, the queue asks for a
+	// resync instead; see TakeResync.
+	Critical Priority = iota
+	// Ephemeral messages, such as note flashes, may be dropped.
+	Ephemeral
+)
+
+// Prioritizer is implemented by messages that declare a priority. Messages
+// that don't are Critical.
+type Prioritizer interface {
+	Priority() Priority
+}
+
+func PriorityOf(msg interface{}) Priority {
+	if p, ok := msg.(Prioritizer); ok {
+		return p.Priority()
+	}
+	return Critical
+}
+
+type entry struct {
+	msg  interface{}
+	seq  uint64
+	prio Priority
+}
+
+// Queue is a bounded per-client send queue. Every pushed message gets the
+// next sequence number, whether or not it survives, so a reader can tell
+// from gaps how much it missed. The overflow policy only ever discards
+// Ephemeral messages; a Critical one evicts an older message of its kind
+// or an Ephemeral one.
+type Queue struct {
+	mu      sync.Mutex
+	buf     []entry
+	head    int
+	size    int
+	policy  Policy
+	seq     uint64
+	dropped uint64
+	resync  bool // a Critical message was lost
+	closed  bool
+	refused bool          // Push refused for being full, so the client is closed
+	ready   chan struct{} // signalled when a message is added or on Close
+	room    chan struct{} // signalled when a message is taken
+
+	// Kept for Stats.
+	highWater int
+	delivered uint64
+	lastWrite time.Duration
+}
+
+// Outcomes of push.
+const (
+	queued = iota
+	dropped
+	refused // closed, or full under Disconnect
+)
+
+func NewQueue(depth int, policy Policy) *Queue {
+	if depth < 1 {
+		depth = 1
+	}
+	return &Queue{
+		buf:    make([]entry, depth),
+		policy: policy,
+		ready:  make(chan struct{}, 1),
+		room:   make(chan struct{}, 1),
+	}
+}
+
+// Push queues msg, applying the overflow policy if the queue is full. It
+// returns false if the queue is closed, or full under Disconnect; the
+// caller should then close the client.
+func (q *Queue) Push(msg interface{}) bool {
+	return q.push(msg, q.policy) != refused
+}
+
+// Offer queues an Ephemeral msg only if there is room, counting it as
+// dropped if not. Critical messages are queued as by Push. It returns
+// false if the message was not queued.
+func (q *Queue) Offer(msg interface{}) bool {
+	return q.push(msg, DropNewest) == queued
+}
+
+func (q *Queue) push(msg interface{}, policy Policy) int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.closed {
+		return refused
+	}
+	q.seq++
+	e := entry{msg: msg, seq: q.seq, prio: PriorityOf(msg)}
+
+	if q.size == len(q.buf) {
+		q.dropped++
+		if policy == Disconnect {
+			q.refused = true
+			return refused
+		}
+		if !q.makeRoom(e, policy) {
+			if e.prio == Critical {
+				q.resync = true
+			}
+			return dropped
+		}
+	}
+
+	q.buf[(q.head+q.size)%len(q.buf)] = e
+	q.size++
+	if q.size > q.highWater {
+		q.highWater = q.size
+	}
+	signal(q.ready)
+	return queued
+}
+
+// makeRoom evicts a message to make way for e, reporting false if e
+// should be dropped instead.
+func (q *Queue) makeRoom(e entry, policy Policy) bool {
+	if e.prio == Critical {
+		// A newer message of the same kind supersedes the old one; failing
+		// that, something disposable goes.
+		return q.removeKey(e.msg) || q.removeOldest(Ephemeral)
+	}
+	switch policy {
+	case DropNewest:
+		return false
+	case Coalesce:
+		return q.removeKey(e.msg) || q.removeOldest(Ephemeral)
+	default:
+		return q.removeOldest(Ephemeral)
+	}
+}
+
+// removeKey drops the oldest queued message sharing msg's coalesce key.
+// The replacement goes to the back, so sequence numbers stay in order.
+func (q *Queue) removeKey(msg interface{}) bool {
+	c, ok := msg.(Coalescer)
+	if !ok {
+		return false
+	}
+	key := c.CoalesceKey()
+	for i := 0; i < q.size; i++ {
+		if other, ok := q.buf[(q.head+i)%len(q.buf)].msg.(Coalescer); ok && other.CoalesceKey() == key {
+			q.removeAt(i)
+			return true
+		}
+	}
+	return false
+}
+
+// removeOldest drops the oldest queued message of priority p.
+func (q *Queue) removeOldest(p Priority) bool {
+	for i := 0; i < q.size; i++ {
+		if q.buf[(q.head+i)%len(q.buf)].prio == p {
+			q.removeAt(i)
+			return true
+		}
+	}
+	return false
+}
+
+// removeAt removes the i-th queued message, shifting later ones forward.
+func (q *Queue) removeAt(i int) {
+	n := len(q.buf)
+	for j := i; j < q.size-1; j++ {
+		q.buf[(q.head+j)%n] = q.buf[(q.head+j+1)%n]
+	}
+	q.buf[(q.head+q.size-1)%n] = entry{}
+	q.size--
+}
+
+// Pop blocks until a message is available and returns it with its
+// sequence number. ok is false once the queue is closed and drained.
+func (q *Queue) Pop() (msg interface{}, seq uint64, ok bool) {
+	for {
+		q.mu.Lock()
+		if q.size > 0 {
+			e := q.buf[q.head]
+			q.buf[q.head] = entry{}
+			q.head = (q.head + 1) % len(q.buf)
+			q.size--
+			q.mu.Unlock()
+			signal(q.room)
+			return e.msg, e.seq, true
+		}
+		if q.closed {
+			q.mu.Unlock()
+			return nil, 0, false
+		}
+		q.mu.Unlock()
+		<-q.ready
+	}
+}
+
+// WaitRoom waits up to d for the queue to have space, reporting whether it
+// does.
+func (q *Queue) WaitRoom(d time.Duration) bool {
+	timeout := time.NewTimer(d)
+	defer timeout.Stop()
+	for {
+		q.mu.Lock()
+		free := q.size < len(q.buf) && !q.closed
+		q.mu.Unlock()
+		if free {
+			return true
+		}
+		select {
+		case <-q.room:
+		case <-timeout.C:
+			return false
+		}
+	}
+}
+
+// Close stops further pushes and wakes Pop. Messages already queued can
+// still be popped.
+func (q *Queue) Close() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if !q.closed {
+		q.closed = true
+		close(q.ready)
+	}
+}
+
+func (q *Queue) Len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.size
+}
+
+// TakeResync reports whether a Critical message has been lost since the
+// last call, in which case the client needs its state sent afresh.
+func (q *Queue) TakeResync() bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	resync := q.resync
+	q.resync = false
+	return resync
+}
+
+// Cap returns the queue depth.
+func (q *Queue) Cap() int {
+	return len(q.buf)
+}
+
+// Written records that the client's writer finished sending a popped
+// message, taking d.
+func (q *Queue) Written(d time.Duration) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.delivered++
+	q.lastWrite = d
+}
+
+// Stats reports how delivery through the queue is going.
+func (q *Queue) Stats() QueueStats {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return QueueStats{
+		Sent:      q.seq,
+		Delivered: q.delivered,
+		Dropped:   q.dropped,
+		Queued:    q.size,
+		HighWater: q.highWater,
+		Capacity:  len(q.buf),
+		LastWrite: float64(q.lastWrite) / float64(time.Millisecond),
+		Refused:   q.refused,
+	}
+}
+
+// Dropped returns how many messages were refused or evicted.
+func (q *Queue) Dropped() uint64 {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.dropped
+}
+
+func signal(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
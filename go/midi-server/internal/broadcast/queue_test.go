@@ -0,0 +1,262 @@
+package broadcast
+
+import (
+	"testing"
+	"time"
+)
+
+// flash is an ephemeral message, like a note.
+type flash int
+
+func (flash) Priority() Priority { return Ephemeral }
+
+// keyed is an ephemeral message that coalesces with others of its key.
+type keyed struct {
+	key string
+	n   int
+}
+
+func (k keyed) CoalesceKey() string { return k.key }
+func (keyed) Priority() Priority    { return Ephemeral }
+
+// cue is a critical message; only the latest one matters.
+type cue string
+
+func (cue) CoalesceKey() string { return "cue" }
+
+// drain pops everything queued, returning the messages and their seqs.
+func drain(q *Queue) (msgs []interface{}, seqs []uint64) {
+	q.Close()
+	for {
+		msg, seq, ok := q.Pop()
+		if !ok {
+			return msgs, seqs
+		}
+		msgs = append(msgs, msg)
+		seqs = append(seqs, seq)
+	}
+}
+
+func TestOverflowPolicies(t *testing.T) {
+	tests := []struct {
+		policy   Policy
+		push     []interface{}
+		want     []interface{}
+		wantSeqs []uint64
+		refused  int // index of the push expected to return false, or -1
+	}{
+		{DropOldest, []interface{}{flash(1), flash(2), flash(3), flash(4)}, []interface{}{flash(2), flash(3), flash(4)}, []uint64{2, 3, 4}, -1},
+		{DropNewest, []interface{}{flash(1), flash(2), flash(3), flash(4)}, []interface{}{flash(1), flash(2), flash(3)}, []uint64{1, 2, 3}, -1},
+		{Disconnect, []interface{}{flash(1), flash(2), flash(3), flash(4)}, []interface{}{flash(1), flash(2), flash(3)}, []uint64{1, 2, 3}, 3},
+		{
+			Coalesce,
+			[]interface{}{keyed{"a", 1}, flash(2), keyed{"b", 1}, keyed{"a", 2}},
+			[]interface{}{flash(2), keyed{"b", 1}, keyed{"a", 2}},
+			[]uint64{2, 3, 4},
+			-1,
+		},
+		{
+			// Nothing to coalesce with, so the oldest goes.
+			Coalesce,
+			[]interface{}{flash(1), flash(2), flash(3), keyed{"a", 1}},
+			[]interface{}{flash(2), flash(3), keyed{"a", 1}},
+			[]uint64{2, 3, 4},
+			-1,
+		},
+	}
+	for _, tt := range tests {
+		q := NewQueue(3, tt.policy)
+		for i, msg := range tt.push {
+			if ok := q.Push(msg); ok != (i != tt.refused) {
+				t.Errorf("%s: push %d returned %v", tt.policy, i, ok)
+			}
+		}
+		if q.Dropped() != 1 {
+			t.Errorf("%s: dropped = %d, want 1", tt.policy, q.Dropped())
+		}
+		msgs, seqs := drain(q)
+		if len(msgs) != len(tt.want) {
+			t.Fatalf("%s: got %v, want %v", tt.policy, msgs, tt.want)
+		}
+		for i := range msgs {
+			if msgs[i] != tt.want[i] || seqs[i] != tt.wantSeqs[i] {
+				t.Errorf("%s: [%d] = %v seq %d, want %v seq %d", tt.policy, i, msgs[i], seqs[i], tt.want[i], tt.wantSeqs[i])
+			}
+		}
+	}
+}
+
+func TestOfferIgnoresPolicy(t *testing.T) {
+	q := NewQueue(1, DropOldest)
+	q.Offer(flash(1))
+	if q.Offer(flash(2)) {
+		t.Error("offer to a full queue should fail")
+	}
+	if msgs, _ := drain(q); len(msgs) != 1 || msgs[0] != flash(1) {
+		t.Errorf("got %v, want [1]", msgs)
+	}
+}
+
+func TestOfferOnDisconnectQueue(t *testing.T) {
+	q := NewQueue(1, Disconnect)
+	q.Offer(flash(1))
+	if q.Offer(flash(2)) {
+		t.Error("offer to a full queue should fail")
+	}
+	if s := q.Stats(); s.Refused || s.Dropped != 1 {
+		t.Errorf("stats = %+v, want the newest dropped without refusing", s)
+	}
+	if q.Push(flash(3)) {
+		t.Error("push to a full Disconnect queue should still refuse")
+	}
+	if msgs, _ := drain(q); len(msgs) != 1 || msgs[0] != flash(1) {
+		t.Errorf("got %v, want [1]", msgs)
+	}
+}
+
+func TestCriticalMessages(t *testing.T) {
+	tests := []struct {
+		name       string
+		policy     Policy
+		push       []interface{}
+		want       []interface{}
+		wantResync bool
+	}{
+		{
+			// Plain values are Critical.
+			"evicts a flash despite drop-newest", DropNewest,
+			[]interface{}{flash(1), 2, flash(3), 4},
+			[]interface{}{2, flash(3), 4},
+			false,
+		},
+		{
+			"replaces an older cue before evicting a flash", DropOldest,
+			[]interface{}{cue("verse"), flash(1), flash(2), cue("chorus")},
+			[]interface{}{flash(1), flash(2), cue("chorus")},
+			false,
+		},
+		{
+			"asks for a resync when nothing can go", DropOldest,
+			[]interface{}{1, 2, 3, cue("chorus")},
+			[]interface{}{1, 2, 3},
+			true,
+		},
+		{
+			"flash can't evict critical messages", DropOldest,
+			[]interface{}{1, 2, 3, flash(4)},
+			[]interface{}{1, 2, 3},
+			false,
+		},
+	}
+	for _, tt := range tests {
+		q := NewQueue(3, tt.policy)
+		for _, msg := range tt.push {
+			if !q.Push(msg) {
+				t.Errorf("%s: push of %v refused", tt.name, msg)
+			}
+		}
+		if got := q.TakeResync(); got != tt.wantResync {
+			t.Errorf("%s: resync = %v", tt.name, got)
+		}
+		if q.TakeResync() {
+			t.Errorf("%s: TakeResync did not reset", tt.name)
+		}
+		msgs, _ := drain(q)
+		if len(msgs) != len(tt.want) {
+			t.Fatalf("%s: got %v, want %v", tt.name, msgs, tt.want)
+		}
+		for i := range msgs {
+			if msgs[i] != tt.want[i] {
+				t.Errorf("%s: [%d] = %v, want %v", tt.name, i, msgs[i], tt.want[i])
+			}
+		}
+	}
+}
+
+func TestLossyNeverSkipsCritical(t *testing.T) {
+	b := &LossyBroadcaster{}
+	list := register(b, 4, 2)
+	for _, c := range list {
+		c.queue.Push(flash(1))
+		c.queue.Push(flash(2))
+	}
+	b.Broadcast(flash(3))
+	b.Broadcast(cue("chorus"))
+
+	for i, c := range list {
+		msgs, _ := drain(c.queue)
+		if len(msgs) != 2 || msgs[0] != flash(2) || msgs[1] != cue("chorus") {
+			t.Errorf("client %d got %v, want [2 chorus]", i, msgs)
+		}
+	}
+}
+
+func TestBatchPriority(t *testing.T) {
+	if p := (Batch{flash(1), flash(2)}).Priority(); p != Ephemeral {
+		t.Errorf("all-flash batch is %v", p)
+	}
+	if p := (Batch{flash(1), cue("verse")}).Priority(); p != Critical {
+		t.Errorf("batch with a cue is %v", p)
+	}
+}
+
+func TestPopWaitsForPush(t *testing.T) {
+	q := NewQueue(4, DropOldest)
+	got := make(chan interface{})
+	go func() {
+		msg, _, _ := q.Pop()
+		got <- msg
+	}()
+	time.Sleep(10 * time.Millisecond)
+	q.Push("hello")
+	select {
+	case msg := <-got:
+		if msg != "hello" {
+			t.Errorf("got %v", msg)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Pop did not wake on Push")
+	}
+}
+
+func TestCloseWakesPop(t *testing.T) {
+	q := NewQueue(4, DropOldest)
+	done := make(chan bool)
+	go func() {
+		_, _, ok := q.Pop()
+		done <- ok
+	}()
+	q.Close()
+	if ok := <-done; ok {
+		t.Error("Pop on a closed, empty queue should report !ok")
+	}
+	if q.Push(1) {
+		t.Error("Push after Close should fail")
+	}
+}
+
+func TestWaitRoom(t *testing.T) {
+	q := NewQueue(1, Disconnect)
+	q.Push(flash(1))
+	if q.WaitRoom(10 * time.Millisecond) {
+		t.Error("full queue reported room")
+	}
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		q.Pop()
+	}()
+	if !q.WaitRoom(time.Second) {
+		t.Error("WaitRoom missed the queue draining")
+	}
+}
+
+func TestParsePolicy(t *testing.T) {
+	for _, p := range []Policy{DropOldest, DropNewest, Coalesce, Disconnect} {
+		if got, err := ParsePolicy(string(p)); err != nil || got != p {
+			t.Errorf("ParsePolicy(%q) = %q, %v", p, got, err)
+		}
+	}
+	if _, err := ParsePolicy("drop-all"); err == nil {
+		t.Error("expected error for unknown policy")
+	}
+}
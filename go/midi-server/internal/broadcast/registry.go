@@ -0,0 +1,72 @@
+package broadcast
+
+import "sync"
+
+// Registration is a client registered with a broadcaster under an ID that
+// is unique among its clients, such as a connection ID.
+type Registration struct {
+	ID     string
+	Client ClientSender
+}
+
+// Registry is the set of clients a broadcaster delivers to. Broadcasters
+// embed it; the zero value is empty and ready to use.
+//
+// Snapshots are copy-on-write: Add and Remove build a new slice, so
+// Broadcast can iterate one without locking and without allocating, and
+// clients may be removed while it does.
+type Registry struct {
+	mu    sync.Mutex
+	index map[string]int
+	list  []Registration
+}
+
+// Add registers c under id, replacing any client already there.
+func (r *Registry) Add(id string, c ClientSender) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.index == nil {
+		r.index = make(map[string]int)
+	}
+	list := make([]Registration, len(r.list), len(r.list)+1)
+	copy(list, r.list)
+	if i, ok := r.index[id]; ok {
+		list[i].Client = c
+	} else {
+		r.index[id] = len(list)
+		list = append(list, Registration{ID: id, Client: c})
+	}
+	r.list = list
+}
+
+// Remove unregisters id. Removing an unknown id does nothing.
+func (r *Registry) Remove(id string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	i, ok := r.index[id]
+	if !ok {
+		return
+	}
+	list := make([]Registration, 0, len(r.list)-1)
+	list = append(list, r.list[:i]...)
+	list = append(list, r.list[i+1:]...)
+	for j := i; j < len(list); j++ {
+		r.index[list[j].ID] = j
+	}
+	delete(r.index, id)
+	r.list = list
+}
+
+// Snapshot returns the registered clients. The slice is shared and must
+// not be modified.
+func (r *Registry) Snapshot() []Registration {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.list
+}
+
+func (r *Registry) Len() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.list)
+}
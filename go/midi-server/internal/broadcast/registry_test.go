@@ -0,0 +1,73 @@
+package broadcast
+
+import "testing"
+
+func ids(regs []Registration) []string {
+	out := make([]string, len(regs))
+	for i, r := range regs {
+		out[i] = r.ID
+	}
+	return out
+}
+
+func TestRegistry(t *testing.T) {
+	var r Registry
+	a, b, c := &testClient{}, &testClient{}, &testClient{}
+	r.Add("a", a)
+	r.Add("b", b)
+	r.Add("c", c)
+	before := r.Snapshot()
+
+	r.Remove("b")
+	r.Remove("missing")
+	if got := ids(r.Snapshot()); len(got) != 2 || got[0] != "a" || got[1] != "c" {
+		t.Errorf("after remove: %v", got)
+	}
+	// Snapshots already handed out don't change.
+	if got := ids(before); len(got) != 3 || got[1] != "b" {
+		t.Errorf("old snapshot changed: %v", got)
+	}
+
+	// Re-adding an ID replaces the client in place; removing after a
+	// shift still finds the right entry.
+	replacement := &testClient{}
+	r.Add("c", replacement)
+	if r.Len() != 2 || r.Snapshot()[1].Client != replacement {
+		t.Errorf("replace: %v", ids(r.Snapshot()))
+	}
+	r.Remove("c")
+	r.Remove("a")
+	if r.Len() != 0 {
+		t.Errorf("not empty: %v", ids(r.Snapshot()))
+	}
+}
+
+func TestRemovedClientGetsNothing(t *testing.T) {
+	b := &DefaultBroadcaster{}
+	list := register(b, 3, 4)
+	b.Remove("client-1")
+	b.Broadcast("cue")
+
+	for i, c := range list {
+		want := 1
+		if i == 1 {
+			want = 0
+		}
+		if c.queue.Len() != want {
+			t.Errorf("client %d has %d messages, want %d", i, c.queue.Len(), want)
+		}
+	}
+}
+
+func TestCoalescingRegistersWithNext(t *testing.T) {
+	next := &LossyBroadcaster{}
+	b := &CoalescingBroadcaster{Next: next}
+	register(b, 2, 4)
+	if next.Len() != 2 || len(b.Snapshot()) != 2 {
+		t.Errorf("next has %d clients, snapshot %d", next.Len(), len(b.Snapshot()))
+	}
+	b.Remove("client-0")
+	if next.Len() != 1 {
+		t.Errorf("remove not forwarded: %v", ids(next.Snapshot()))
+	}
+}
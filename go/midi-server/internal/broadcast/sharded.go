@@ -0,0 +1,84 @@
+package broadcast
+
+import (
+	"runtime"
+	"sync"
+)
+
+// ShardedBroadcaster splits clients across a fixed pool of worker
+// goroutines, one per CPU unless Workers is set. Unlike BatchBroadcaster it
+// starts no goroutines per message, so its cost stays flat at thousands of
+// clients. Workers start on the first Broadcast and run until Stop.
+type ShardedBroadcaster struct {
+	Registry
+	Workers int
+
+	start sync.Once
+	jobs  []chan shardJob
+	mu    sync.Mutex // serialises broadcasts so done can be reused
+	done  sync.WaitGroup
+}
+
+type shardJob struct {
+	clients []Registration
+	message interface{}
+	done    *sync.WaitGroup
+}
+
+func (b *ShardedBroadcaster) Broadcast(message interface{}) {
+	b.start.Do(b.startWorkers)
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	list := b.Snapshot()
+	if len(b.jobs) == 0 {
+		// Stopped: a coalesced batch can still arrive late.
+		for _, r := range list {
+			deliver(r.Client, message)
+		}
+		return
+	}
+	shard := (len(list) + len(b.jobs) - 1) / len(b.jobs)
+	for i := 0; i < len(b.jobs) && i*shard < len(list); i++ {
+		end := (i + 1) * shard
+		if end > len(list) {
+			end = len(list)
+		}
+		b.done.Add(1)
+		b.jobs[i] <- shardJob{clients: list[i*shard : end], message: message, done: &b.done}
+	}
+	b.done.Wait()
+}
+
+func (b *ShardedBroadcaster) startWorkers() {
+	n := b.Workers
+	if n <= 0 {
+		n = runtime.GOMAXPROCS(0)
+	}
+	b.jobs = make([]chan shardJob, n)
+	for i := range b.jobs {
+		b.jobs[i] = make(chan shardJob)
+		go shardWorker(b.jobs[i])
+	}
+}
+
+func shardWorker(jobs <-chan shardJob) {
+	for job := range jobs {
+		for _, r := range job.clients {
+			deliver(r.Client, job.message)
+		}
+		job.done.Done()
+	}
+}
+
+// Stop ends the workers. Later broadcasts are delivered on the caller's
+// goroutine.
+func (b *ShardedBroadcaster) Stop() {
+	b.start.Do(func() {})
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, jobs := range b.jobs {
+		close(jobs)
+	}
+	b.jobs = nil
+}
@@ -0,0 +1,70 @@
+package broadcast
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestShardedReachesEveryClient(t *testing.T) {
+	for _, n := range []int{0, 1, 3, 4, 5, 1000} {
+		b := &ShardedBroadcaster{Workers: 4}
+		list := register(b, n, 4)
+		b.Broadcast("cue")
+		b.Broadcast("note")
+		b.Stop()
+
+		for i, c := range list {
+			if c.queue.Len() != 2 {
+				t.Fatalf("%d clients: client %d has %d messages, want 2", n, i, c.queue.Len())
+			}
+		}
+	}
+}
+
+func TestShardedClosesOnDisconnectPolicy(t *testing.T) {
+	b := &ShardedBroadcaster{Workers: 3}
+	defer b.Stop()
+	list := register(b, 8, 1)
+	for _, c := range list {
+		c.queue = NewQueue(1, Disconnect)
+	}
+	b.Broadcast(1)
+	b.Broadcast(2)
+
+	// Broadcast waits for its workers, so the closes are visible now.
+	for i, c := range list {
+		if !c.closed {
+			t.Errorf("client %d with a full queue was not closed", i)
+		}
+	}
+}
+
+func BenchmarkBroadcasters(b *testing.B) {
+	broadcasters := []struct {
+		name string
+		new  func() Broadcaster
+	}{
+		{"default", func() Broadcaster { return &DefaultBroadcaster{} }},
+		{"batch", func() Broadcaster { return &BatchBroadcaster{} }},
+		{"sharded", func() Broadcaster { return &ShardedBroadcaster{} }},
+	}
+	for _, size := range []int{1000, 5000, 10000} {
+		// Full drop-oldest queues: every push evicts, which is the steady
+		// state of a busy hub with slow phones.
+		for _, bc := range broadcasters {
+			b.Run(fmt.Sprintf("%s/%d", bc.name, size), func(b *testing.B) {
+				br := bc.new()
+				register(br, size, 16)
+				if s, ok := br.(*ShardedBroadcaster); ok {
+					defer s.Stop()
+				}
+				b.ReportAllocs()
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					br.Broadcast(flash(i))
+				}
+				b.ReportMetric(float64(b.Elapsed().Nanoseconds())/float64(b.N*size), "ns/client")
+			})
+		}
+	}
+}
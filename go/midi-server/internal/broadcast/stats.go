@@ -0,0 +1,50 @@
+package broadcast
+
+import "sort"
+
+// QueueStats describes delivery to one client.
+type QueueStats struct {
+	Sent      uint64  `json:"sent"`      // messages pushed, dropped ones included
+	Delivered uint64  `json:"delivered"` // messages the writer finished sending
+	Dropped   uint64  `json:"dropped"`
+	Queued    int     `json:"queued"`
+	HighWater int     `json:"high_water"` // most messages ever queued at once
+	Capacity  int     `json:"capacity"`
+	LastWrite float64 `json:"last_write_ms"` // time the last write took
+	Refused   bool    `json:"refused"`       // overflowed under Disconnect and was closed
+}
+
+// Backlog is how full the queue is, from 0 to 1.
+func (s QueueStats) Backlog() float64 {
+	return float64(s.Queued) / float64(s.Capacity)
+}
+
+// ClientStats is a registered client's QueueStats.
+type ClientStats struct {
+	ID string `json:"id"`
+	QueueStats
+}
+
+// Slowest returns up to n of the registered clients, furthest behind
+// first: by how full their queue is, then by how long their last write
+// took, then by how much they have dropped. n <= 0 returns them all.
+func Slowest(regs []Registration, n int) []ClientStats {
+	list := make([]ClientStats, len(regs))
+	for i, r := range regs {
+		list[i] = ClientStats{ID: r.ID, QueueStats: r.Client.SendQueue().Stats()}
+	}
+	sort.SliceStable(list, func(i, j int) bool {
+		a, b := list[i], list[j]
+		if a.Backlog() != b.Backlog() {
+			return a.Backlog() > b.Backlog()
+		}
+		if a.LastWrite != b.LastWrite {
+			return a.LastWrite > b.LastWrite
+		}
+		return a.Dropped > b.Dropped
+	})
+	if n > 0 && n < len(list) {
+		list = list[:n]
+	}
+	return list
+}
@@ -0,0 +1,75 @@
+package broadcast
+
+import (
+	"testing"
+	"time"
+)
+
+func TestQueueStats(t *testing.T) {
+	q := NewQueue(3, DropOldest)
+	for i := 0; i < 5; i++ {
+		q.Push(flash(i))
+	}
+	q.Pop()
+	q.Written(4 * time.Millisecond)
+	q.Pop()
+	q.Written(2 * time.Millisecond)
+
+	want := QueueStats{Sent: 5, Delivered: 2, Dropped: 2, Queued: 1, HighWater: 3, Capacity: 3, LastWrite: 2}
+	if got := q.Stats(); got != want {
+		t.Errorf("stats = %+v, want %+v", got, want)
+	}
+
+	q = NewQueue(1, Disconnect)
+	q.Push(flash(0))
+	q.Push(flash(1))
+	if s := q.Stats(); !s.Refused || s.Dropped != 1 {
+		t.Errorf("disconnect stats = %+v, want refused with one drop", s)
+	}
+}
+
+func TestLossyOverflowIsNotRefused(t *testing.T) {
+	b := &LossyBroadcaster{}
+	c := &testClient{queue: NewQueue(1, Disconnect)}
+	b.Add("client-0", c)
+	b.Broadcast(flash(1))
+	b.Broadcast(flash(2))
+
+	// The lossy path skips the message and keeps the client, so its
+	// stats must not say it was refused.
+	got := Slowest(b.Snapshot(), 1)
+	if c.closed || len(got) != 1 || got[0].Refused || got[0].Dropped != 1 {
+		t.Errorf("closed %v, stats %+v; want open and not refused with one drop", c.closed, got)
+	}
+}
+
+func TestSlowest(t *testing.T) {
+	b := &DefaultBroadcaster{}
+	list := register(b, 4, 4)
+	// client-0 is fine, client-1 is half full, client-2 writes slowly and
+	// client-3 is full.
+	list[0].queue.Written(time.Millisecond)
+	list[1].queue.Push(flash(0))
+	list[1].queue.Push(flash(1))
+	list[2].queue.Written(300 * time.Millisecond)
+	for i := 0; i < 6; i++ {
+		list[3].queue.Push(flash(i))
+	}
+
+	got := Slowest(b.Snapshot(), 3)
+	want := []string{"client-3", "client-1", "client-2"}
+	if len(got) != len(want) {
+		t.Fatalf("got %d clients, want %d", len(got), len(want))
+	}
+	for i, c := range got {
+		if c.ID != want[i] {
+			t.Errorf("slowest[%d] = %s, want %s", i, c.ID, want[i])
+		}
+	}
+	if got[0].Dropped != 2 || got[0].Backlog() != 1 {
+		t.Errorf("client-3 stats = %+v", got[0].QueueStats)
+	}
+	if all := Slowest(b.Snapshot(), 0); len(all) != 4 || all[3].ID != "client-0" {
+		t.Errorf("Slowest(0) = %+v", all)
+	}
+}
@@ -0,0 +1,126 @@
+package broadcast
+
+import "sync"
+
+// Switchable is a Broadcaster whose strategy can be replaced while clients
+// are connected. Swap moves every registration to the new broadcaster, so
+// nobody is disconnected, and broadcasts wait until a swap has finished.
+//
+// The lock only guards the switcher's own fields; the wrapped broadcasters
+// are always called without it, because delivering can close a client and
+// closing a client calls Remove.
+type Switchable struct {
+	swapping sync.Mutex     // held for the whole of a Swap
+	sending  sync.WaitGroup // broadcasts that started before a swap
+
+	mu      sync.Mutex
+	current Broadcaster
+	prev    Broadcaster     // being retired while a swap is in flight
+	removed map[string]bool // removed while a swap is in flight
+	moved   chan struct{}   // closed when the swap in flight finishes
+}
+
+// NewSwitchable starts with b.
+func NewSwitchable(b Broadcaster) *Switchable {
+	return &Switchable{current: b}
+}
+
+// Current returns the broadcaster in use.
+func (s *Switchable) Current() Broadcaster {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.current
+}
+
+// Swap registers every current client with next, makes it the active
+// broadcaster and retires the previous one, which it returns. Messages the
+// previous broadcaster was holding back are delivered before any sent
+// through next.
+func (s *Switchable) Swap(next Broadcaster) Broadcaster {
+	s.swapping.Lock()
+	defer s.swapping.Unlock()
+
+	s.mu.Lock()
+	prev := s.current
+	if prev == next {
+		s.mu.Unlock()
+		return prev
+	}
+	s.current, s.prev = next, prev
+	s.removed = make(map[string]bool)
+	s.moved = make(chan struct{})
+	s.mu.Unlock()
+
+	if prev != nil {
+		for _, r := range prev.Snapshot() {
+			next.Add(r.ID, r.Client)
+		}
+		s.sending.Wait()
+		retire(prev)
+	}
+
+	s.mu.Lock()
+	removed, moved := s.removed, s.moved
+	s.prev, s.removed, s.moved = nil, nil, nil
+	s.mu.Unlock()
+	// A client that left mid-swap may have been moved after it was removed.
+	for id := range removed {
+		next.Remove(id)
+	}
+	close(moved)
+	return prev
+}
+
+// retire finishes with a broadcaster that has been swapped out: anything
+// it holds back is delivered and its workers are stopped.
+func retire(b Broadcaster) {
+	switch b := b.(type) {
+	case *CoalescingBroadcaster:
+		b.Flush()
+		retire(b.next())
+	case *ShardedBroadcaster:
+		b.Stop()
+	}
+}
+
+func (s *Switchable) Add(id string, c ClientSender) {
+	s.mu.Lock()
+	cur := s.current
+	delete(s.removed, id)
+	s.mu.Unlock()
+	cur.Add(id, c)
+}
+
+func (s *Switchable) Remove(id string) {
+	s.mu.Lock()
+	cur, prev := s.current, s.prev
+	if s.removed != nil {
+		s.removed[id] = true
+	}
+	s.mu.Unlock()
+	cur.Remove(id)
+	if prev != nil {
+		prev.Remove(id)
+	}
+}
+
+func (s *Switchable) Snapshot() []Registration {
+	return s.Current().Snapshot()
+}
+
+func (s *Switchable) Broadcast(message interface{}) {
+	for {
+		s.mu.Lock()
+		cur, moved := s.current, s.moved
+		if moved == nil {
+			s.sending.Add(1)
+		}
+		s.mu.Unlock()
+		if moved == nil {
+			cur.Broadcast(message)
+			s.sending.Done()
+			return
+		}
+		<-moved
+	}
+}
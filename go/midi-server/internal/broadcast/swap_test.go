@@ -0,0 +1,116 @@
+package broadcast
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestSwapKeepsClients(t *testing.T) {
+	s := NewSwitchable(&DefaultBroadcaster{})
+	list := register(s, 3, 8)
+	s.Broadcast("before")
+
+	prev := s.Swap(&LossyBroadcaster{})
+	if _, ok := prev.(*DefaultBroadcaster); !ok {
+		t.Errorf("Swap returned %T, want the previous broadcaster", prev)
+	}
+	if _, ok := s.Current().(*LossyBroadcaster); !ok {
+		t.Errorf("Current is %T after swap", s.Current())
+	}
+	if got := ids(s.Snapshot()); fmt.Sprint(got) != "[client-0 client-1 client-2]" {
+		t.Errorf("registrations after swap: %v", got)
+	}
+
+	s.Remove("client-1")
+	s.Broadcast("after")
+	for i, c := range list {
+		msgs, _ := drain(c.queue)
+		want := "[before after]"
+		if i == 1 {
+			want = "[before]"
+		}
+		if fmt.Sprint(msgs) != want || c.closed {
+			t.Errorf("client %d got %v (closed %v), want %s", i, msgs, c.closed, want)
+		}
+	}
+}
+
+func TestSwapFlushesCoalesced(t *testing.T) {
+	s := NewSwitchable(&CoalescingBroadcaster{Window: time.Hour, Next: &ShardedBroadcaster{Workers: 2}})
+	list := register(s, 2, 8)
+	s.Broadcast(flash(1))
+	s.Broadcast(flash(2))
+
+	s.Swap(&DefaultBroadcaster{})
+	s.Broadcast(flash(3))
+	for i, c := range list {
+		msgs, _ := drain(c.queue)
+		if fmt.Sprint(msgs) != fmt.Sprint([]interface{}{Batch{flash(1), flash(2)}, flash(3)}) {
+			t.Errorf("client %d got %v, want the held batch before the new message", i, msgs)
+		}
+	}
+}
+
+func TestSwapWhileConnecting(t *testing.T) {
+	s := NewSwitchable(&BufferedBroadcaster{})
+	var wg sync.WaitGroup
+	for i := 0; i < 200; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			s.Add(fmt.Sprint(i), &testClient{queue: NewQueue(4, DropOldest)})
+		}(i)
+	}
+	for _, next := range []Broadcaster{&ShardedBroadcaster{}, &DefaultBroadcaster{}, &BatchBroadcaster{}} {
+		s.Swap(next)
+		s.Broadcast(flash(0))
+	}
+	wg.Wait()
+	if n := len(s.Snapshot()); n != 200 {
+		t.Errorf("%d clients registered, want 200", n)
+	}
+}
+
+// leavingClient unregisters itself when closed, like a connection does.
+type leavingClient struct {
+	id    string
+	queue *Queue
+	s     *Switchable
+}
+
+func (c *leavingClient) SendQueue() *Queue { return c.queue }
+func (c *leavingClient) Close()            { c.s.Remove(c.id) }
+
+func TestSwapWhileClientCloses(t *testing.T) {
+	s := NewSwitchable(&CoalescingBroadcaster{Window: time.Hour, Next: &ShardedBroadcaster{Workers: 2}})
+	slow := &leavingClient{id: "slow", queue: NewQueue(1, Disconnect), s: s}
+	slow.queue.Push(flash(0))
+	s.Add(slow.id, slow)
+	list := register(s, 2, 8)
+	s.Broadcast(flash(1))
+
+	// The flush overflows the slow client's queue, so it closes, and
+	// removes itself, from inside the swap.
+	done := make(chan struct{})
+	go func() {
+		s.Swap(&DefaultBroadcaster{})
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Swap deadlocked on a client closing during delivery")
+	}
+
+	s.Broadcast(flash(2))
+	if got := ids(s.Snapshot()); fmt.Sprint(got) != "[client-0 client-1]" {
+		t.Errorf("registrations after swap: %v", got)
+	}
+	for i, c := range list {
+		if msgs, _ := drain(c.queue); len(msgs) != 2 {
+			t.Errorf("client %d got %v, want the flushed batch and flash 2", i, msgs)
+		}
+	}
+}
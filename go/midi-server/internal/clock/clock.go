@@ -0,0 +1,155 @@
+// Package clock follows MIDI clock (24 pulses per quarter note plus
+// start/stop/continue) to derive tempo and bar position, and can generate
+// clock at a fixed tempo when the server is the master.
+package clock
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+const PulsesPerBeat = 24
+
+// MIDI realtime status bytes.
+const (
+	StatusClock    byte = 0xF8
+	StatusStart    byte = 0xFA
+	StatusContinue byte = 0xFB
+	StatusStop     byte = 0xFC
+)
+
+// Beat describes a quarter-note beat. Bar and BeatInBar count from 1.
+type Beat struct {
+	Count     int
+	Bar       int
+	BeatInBar int
+	BPM       float64
+	Time      time.Time
+}
+
+type Clock struct {
+	mu          sync.Mutex
+	beatsPerBar int
+	running     bool
+	pulses      int
+	beats       int
+	lastBeat    time.Time
+	bpm         float64
+	onBeat      func(Beat)
+}
+
+// New returns a stopped clock that calls onBeat on every beat while running.
+func New(beatsPerBar int, onBeat func(Beat)) *Clock {
+	if beatsPerBar <= 0 {
+		beatsPerBar = 4
+	}
+	return &Clock{beatsPerBar: beatsPerBar, onBeat: onBeat}
+}
+
+// Start rewinds to the top of bar 1 and starts counting beats.
+func (c *Clock) Start() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.running = true
+	c.pulses = 0
+	c.beats = 0
+	c.lastBeat = time.Time{}
+}
+
+// Continue resumes counting from where Stop left off.
+func (c *Clock) Continue() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.running = true
+}
+
+func (c *Clock) Stop() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.running = false
+}
+
+func (c *Clock) Running() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.running
+}
+
+// Tempo returns the tempo measured over the last beat, or 0 if unknown.
+func (c *Clock) Tempo() float64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.bpm
+}
+
+// Pulse handles one clock pulse received at now. Tempo is tracked even while
+// stopped, since most sequencers send clock continuously.
+func (c *Clock) Pulse(now time.Time) {
+	c.mu.Lock()
+	if c.pulses%PulsesPerBeat != 0 {
+		c.pulses++
+		c.mu.Unlock()
+		return
+	}
+	c.pulses++
+
+	if !c.lastBeat.IsZero() {
+		if interval := now.Sub(c.lastBeat); interval > 0 {
+			c.bpm = float64(time.Minute) / float64(interval)
+		}
+	}
+	c.lastBeat = now
+
+	if !c.running {
+		c.mu.Unlock()
+		return
+	}
+	beat := Beat{
+		Count:     c.beats,
+		Bar:       c.beats/c.beatsPerBar + 1,
+		BeatInBar: c.beats%c.beatsPerBar + 1,
+		BPM:       c.bpm,
+		Time:      now,
+	}
+	c.beats++
+	onBeat := c.onBeat
+	c.mu.Unlock()
+
+	if onBeat != nil {
+		onBeat(beat)
+	}
+}
+
+// Generator sends MIDI clock at a fixed tempo and feeds the same pulses to
+// a local Clock, so the server can act as clock master.
+type Generator struct {
+	BPM   float64
+	Send  func(status byte)
+	Clock *Clock
+}
+
+// Run sends Start, then a clock pulse every 1/24 beat until ctx is done,
+// then Stop.
+func (g *Generator) Run(ctx context.Context) {
+	interval := time.Duration(float64(time.Minute) / (g.BPM * PulsesPerBeat))
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	g.Send(StatusStart)
+	g.Clock.Start()
+	g.Send(StatusClock)
+	g.Clock.Pulse(time.Now())
+
+	for {
+		select {
+		case <-ctx.Done():
+			g.Send(StatusStop)
+			g.Clock.Stop()
+			return
+		case t := <-ticker.C:
+			g.Send(StatusClock)
+			g.Clock.Pulse(t)
+		}
+	}
+}
@@ -0,0 +1,87 @@
+package clock
+
+import (
+	"context"
+	"math"
+	"sync"
+	"testing"
+	"time"
+)
+
+func pulses(c *Clock, start time.Time, bpm float64, n int) time.Time {
+	interval := time.Duration(float64(time.Minute) / (bpm * PulsesPerBeat))
+	t := start
+	for i := 0; i < n; i++ {
+		c.Pulse(t)
+		t = t.Add(interval)
+	}
+	return t
+}
+
+func TestClockCountsBeatsAndBars(t *testing.T) {
+	var beats []Beat
+	c := New(3, func(b Beat) { beats = append(beats, b) })
+
+	start := time.Now()
+	pulses(c, start, 90, PulsesPerBeat) // stopped: tempo only
+	if len(beats) != 0 {
+		t.Fatalf("expected no beats while stopped, got %d", len(beats))
+	}
+
+	c.Start()
+	next := pulses(c, start, 90, 4*PulsesPerBeat)
+	if len(beats) != 4 {
+		t.Fatalf("expected 4 beats, got %d", len(beats))
+	}
+	last := beats[3]
+	if last.Bar != 2 || last.BeatInBar != 1 || last.Count != 3 {
+		t.Errorf("4th beat in 3/4 should be bar 2 beat 1, got %+v", last)
+	}
+	if math.Abs(c.Tempo()-90) > 0.5 {
+		t.Errorf("Tempo() = %.2f, want 90", c.Tempo())
+	}
+
+	c.Stop()
+	next = pulses(c, next, 90, PulsesPerBeat)
+	c.Continue()
+	pulses(c, next, 90, PulsesPerBeat)
+	if got := beats[len(beats)-1]; got.Count != 4 {
+		t.Errorf("continue should resume at beat 4, got %d", got.Count)
+	}
+}
+
+func TestGeneratorSendsClock(t *testing.T) {
+	var mu sync.Mutex
+	sent := map[byte]int{}
+	var beats int
+	c := New(4, func(Beat) {
+		mu.Lock()
+		beats++
+		mu.Unlock()
+	})
+	g := &Generator{
+		BPM:   600, // one beat every 100ms keeps the test short
+		Clock: c,
+		Send: func(status byte) {
+			mu.Lock()
+			sent[status]++
+			mu.Unlock()
+		},
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 250*time.Millisecond)
+	defer cancel()
+	g.Run(ctx)
+
+	mu.Lock()
+	defer mu.Unlock()
+	if sent[StatusStart] != 1 || sent[StatusStop] != 1 {
+		t.Errorf("expected one start and one stop, got %v", sent)
+	}
+	if sent[StatusClock] < PulsesPerBeat {
+		t.Errorf("expected at least a beat of clock pulses, got %d", sent[StatusClock])
+	}
+	if beats < 2 {
+		t.Errorf("expected at least 2 beats, got %d", beats)
+	}
+}
@@ -0,0 +1,178 @@
+// Package dynamics shapes note velocity: per-scene curves, velocity taken
+// from touch pressure or duration, and a "crowd intensity" boost when many
+// clients press the same note at once.
+package dynamics
+
+import (
+	"fmt"
+	"math"
+	"sync"
+	"time"
+)
+
+// Touch is what a client tells us about a press. Pressure (0-1) and
+// Duration (milliseconds) are optional.
+type Touch struct {
+	Velocity uint8
+	Pressure *float64
+	Duration *float64
+}
+
+// Crowd settings boost velocity when several presses of the same note land
+// within Window of each other.
+type Crowd struct {
+	Window string `json:"window"` // duration such as "200ms"
+	Boost  int    `json:"boost"`  // velocity added per additional press
+}
+
+// Config is the "velocity" section of a scene.
+type Config struct {
+	Curve  string  `json:"curve"`  // fixed, linear, exponential or compressed
+	Source string  `json:"source"` // client (default), pressure or duration
+	Min    uint8   `json:"min"`
+	Max    uint8   `json:"max"`
+	Value  uint8   `json:"value"` // for the fixed curve
+	Gamma  float64 `json:"gamma"` // exponent for the exponential curve; default 2
+	Ratio  float64 `json:"ratio"` // squeeze toward the middle for compressed; default 2
+
+	// DurationRange is the press length in milliseconds that maps to the
+	// softest note; shorter, sharper presses are louder. Default 500.
+	DurationRange float64 `json:"durationRange"`
+
+	Crowd *Crowd `json:"crowd"`
+
+	window time.Duration
+}
+
+func (c *Config) Validate() error {
+	switch c.Curve {
+	case "", "fixed", "linear", "exponential", "compressed":
+	default:
+		return fmt.Errorf("unknown velocity curve %q", c.Curve)
+	}
+	switch c.Source {
+	case "", "client", "pressure", "duration":
+	default:
+		return fmt.Errorf("unknown velocity source %q", c.Source)
+	}
+	if c.Min > 127 || c.Max > 127 || c.Value > 127 {
+		return fmt.Errorf("velocities must be 0-127")
+	}
+	if c.Max != 0 && c.Min > c.Max {
+		return fmt.Errorf("velocity min %d is above max %d", c.Min, c.Max)
+	}
+	if c.Crowd != nil {
+		d, err := time.ParseDuration(c.Crowd.Window)
+		if err != nil || d <= 0 {
+			return fmt.Errorf("crowd window %q is not a duration", c.Crowd.Window)
+		}
+		c.window = d
+	}
+	return nil
+}
+
+// level returns the press intensity in 0-1 from the configured source,
+// falling back to the client velocity when the touch lacks that data.
+func (c *Config) level(t Touch) float64 {
+	switch c.Source {
+	case "pressure":
+		if t.Pressure != nil {
+			return clamp01(*t.Pressure)
+		}
+	case "duration":
+		if t.Duration != nil {
+			rng := c.DurationRange
+			if rng <= 0 {
+				rng = 500
+			}
+			return 1 - clamp01(*t.Duration/rng)
+		}
+	}
+	return float64(t.Velocity) / 127
+}
+
+// Shape returns the velocity for a press. presses is how many presses of
+// the same note the crowd tracker has seen in the window, including this one.
+func (c *Config) Shape(t Touch, presses int) uint8 {
+	lo, hi := float64(c.Min), float64(c.Max)
+	if c.Max == 0 {
+		hi = 127
+	}
+
+	x := c.level(t)
+	var v float64
+	switch c.Curve {
+	case "fixed":
+		v = float64(c.Value)
+		if c.Value == 0 {
+			v = 100
+		}
+	case "exponential":
+		gamma := c.Gamma
+		if gamma <= 0 {
+			gamma = 2
+		}
+		v = lo + math.Pow(x, gamma)*(hi-lo)
+	case "compressed":
+		ratio := c.Ratio
+		if ratio <= 1 {
+			ratio = 2
+		}
+		v = lo + (0.5+(x-0.5)/ratio)*(hi-lo)
+	default:
+		v = lo + x*(hi-lo)
+	}
+
+	if c.Crowd != nil && presses > 1 {
+		v += float64(c.Crowd.Boost * (presses - 1))
+		v = math.Min(v, hi)
+	}
+
+	if v < 1 {
+		v = 1
+	}
+	if v > 127 {
+		v = 127
+	}
+	return uint8(math.Round(v))
+}
+
+// CrowdWindow returns the parsed crowd window, or 0 if crowd boost is off.
+func (c *Config) CrowdWindow() time.Duration {
+	if c.Crowd == nil {
+		return 0
+	}
+	return c.window
+}
+
+// Tracker counts recent presses per note across all clients.
+type Tracker struct {
+	mu      sync.Mutex
+	presses map[uint8][]time.Time
+}
+
+func NewTracker() *Tracker {
+	return &Tracker{presses: make(map[uint8][]time.Time)}
+}
+
+// Press records a press of note at now and returns how many presses of that
+// note happened within window, including this one.
+func (t *Tracker) Press(note uint8, now time.Time, window time.Duration) int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	cutoff := now.Add(-window)
+	kept := t.presses[note][:0]
+	for _, p := range t.presses[note] {
+		if p.After(cutoff) {
+			kept = append(kept, p)
+		}
+	}
+	kept = append(kept, now)
+	t.presses[note] = kept
+	return len(kept)
+}
+
+func clamp01(x float64) float64 {
+	return math.Max(0, math.Min(1, x))
+}
@@ -0,0 +1,89 @@
+package dynamics
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCurves(t *testing.T) {
+	half := Touch{Velocity: 64} // level ~0.5
+	cases := []struct {
+		cfg  Config
+		want uint8
+	}{
+		{Config{Curve: "fixed", Value: 90}, 90},
+		{Config{Curve: "linear", Min: 20, Max: 120}, 70},
+		{Config{Curve: "exponential", Min: 0, Max: 127, Gamma: 2}, 32},
+		{Config{Curve: "compressed", Min: 40, Max: 120, Ratio: 4}, 80},
+	}
+	for _, c := range cases {
+		if err := c.cfg.Validate(); err != nil {
+			t.Fatalf("%s: %v", c.cfg.Curve, err)
+		}
+		if got := c.cfg.Shape(half, 1); got != c.want {
+			t.Errorf("%s curve: Shape = %d, want %d", c.cfg.Curve, got, c.want)
+		}
+	}
+}
+
+func TestPressureAndDurationSources(t *testing.T) {
+	pressure := 1.0
+	duration := 250.0
+
+	cfg := Config{Source: "pressure", Min: 0, Max: 100}
+	if got := cfg.Shape(Touch{Velocity: 10, Pressure: &pressure}, 1); got != 100 {
+		t.Errorf("full pressure = %d, want 100", got)
+	}
+	if got := cfg.Shape(Touch{Velocity: 127}, 1); got != 100 {
+		t.Errorf("missing pressure should fall back to client velocity, got %d", got)
+	}
+
+	cfg = Config{Source: "duration", Min: 0, Max: 100, DurationRange: 500}
+	if got := cfg.Shape(Touch{Duration: &duration}, 1); got != 50 {
+		t.Errorf("half-range duration = %d, want 50", got)
+	}
+}
+
+func TestCrowdBoost(t *testing.T) {
+	cfg := Config{Curve: "fixed", Value: 60, Max: 100, Crowd: &Crowd{Window: "200ms", Boost: 10}}
+	if err := cfg.Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	tracker := NewTracker()
+	now := time.Now()
+	var got uint8
+	for i := 0; i < 3; i++ {
+		n := tracker.Press(64, now.Add(time.Duration(i)*10*time.Millisecond), cfg.CrowdWindow())
+		got = cfg.Shape(Touch{Velocity: 100}, n)
+	}
+	if got != 80 {
+		t.Errorf("third simultaneous press = %d, want 80", got)
+	}
+
+	n := tracker.Press(64, now.Add(time.Second), cfg.CrowdWindow())
+	if n != 1 {
+		t.Errorf("press after the window should count alone, got %d", n)
+	}
+
+	for i := 0; i < 10; i++ {
+		n = tracker.Press(67, now, cfg.CrowdWindow())
+	}
+	if got := cfg.Shape(Touch{}, n); got != 100 {
+		t.Errorf("crowd boost should stop at max, got %d", got)
+	}
+}
+
+func TestValidateRejectsBadConfig(t *testing.T) {
+	bad := []Config{
+		{Curve: "s-curve"},
+		{Source: "mood"},
+		{Min: 100, Max: 50},
+		{Crowd: &Crowd{Window: "often"}},
+	}
+	for _, c := range bad {
+		if err := c.Validate(); err == nil {
+			t.Errorf("expected error for %+v", c)
+		}
+	}
+}
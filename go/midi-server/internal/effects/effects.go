@@ -0,0 +1,207 @@
+// Package effects turns a single audience press into several notes: chord
+// expansion, an arpeggiator and an echo, configured per scene.
+package effects
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"time"
+
+	"github.com/radcliffetech/midi-lab/go/midi-server/internal/quantize"
+	"github.com/radcliffetech/midi-lab/go/midi-server/internal/scale"
+)
+
+// Event is a note to play Offset after the original press.
+type Event struct {
+	Offset   time.Duration
+	Note     uint8
+	Velocity uint8
+}
+
+type Arpeggio struct {
+	Mode    string `json:"mode"`    // up, down, updown or random
+	Rate    string `json:"rate"`    // grid such as "1/16", synced to tempo
+	Octaves int    `json:"octaves"` // how many octaves to span; default 1
+}
+
+type Echo struct {
+	Repeats int     `json:"repeats"`
+	Delay   string  `json:"delay"` // grid such as "1/8", or a duration such as "250ms"
+	Decay   float64 `json:"decay"` // velocity multiplier per repeat; default 0.6
+}
+
+// Config is the "effects" section of a scene. Chord is "triad" or "seventh",
+// built by stacking thirds in the scene's scale.
+type Config struct {
+	Chord    string    `json:"chord"`
+	Arpeggio *Arpeggio `json:"arpeggio"`
+	Echo     *Echo     `json:"echo"`
+}
+
+var chordSteps = map[string][]int{
+	"triad":   {0, 2, 4},
+	"seventh": {0, 2, 4, 6},
+}
+
+// major is used to build chords when the scene has no scale.
+var major, _ = scale.Parse("C", "major")
+
+func (c *Config) Validate() error {
+	if c.Chord != "" {
+		if _, ok := chordSteps[c.Chord]; !ok {
+			return fmt.Errorf("unknown chord %q (want triad or seventh)", c.Chord)
+		}
+	}
+	if a := c.Arpeggio; a != nil {
+		switch a.Mode {
+		case "", "up", "down", "updown", "random":
+		default:
+			return fmt.Errorf("unknown arpeggio mode %q", a.Mode)
+		}
+		if _, err := quantize.ParseGrid(a.rate()); err != nil {
+			return fmt.Errorf("arpeggio rate: %v", err)
+		}
+	}
+	if e := c.Echo; e != nil {
+		if _, err := e.delay(120); err != nil {
+			return err
+		}
+		if e.Decay < 0 || e.Decay > 1 {
+			return fmt.Errorf("echo decay %v must be between 0 and 1", e.Decay)
+		}
+	}
+	return nil
+}
+
+func (a *Arpeggio) rate() string {
+	if a.Rate == "" {
+		return "1/16"
+	}
+	return a.Rate
+}
+
+func (e *Echo) delay(bpm float64) (time.Duration, error) {
+	delay := e.Delay
+	if delay == "" {
+		delay = "1/8"
+	}
+	if beats, err := quantize.ParseGrid(delay); err == nil {
+		return beatsToDuration(beats, bpm), nil
+	}
+	d, err := time.ParseDuration(delay)
+	if err != nil || d <= 0 {
+		return 0, fmt.Errorf("echo delay %q is neither a grid nor a duration", delay)
+	}
+	return d, nil
+}
+
+func beatsToDuration(beats, bpm float64) time.Duration {
+	return time.Duration(beats * float64(time.Minute) / bpm)
+}
+
+// Apply expands a press into the events to play. sc may be nil, in which
+// case chords are built from the major scale on the pressed note.
+func (c *Config) Apply(note, velocity uint8, sc *scale.Scale, bpm float64) []Event {
+	if bpm <= 0 {
+		bpm = 120
+	}
+
+	notes := []uint8{note}
+	if steps, ok := chordSteps[c.Chord]; ok {
+		notes = chord(note, sc, steps)
+	}
+
+	var events []Event
+	if c.Arpeggio != nil {
+		events = c.Arpeggio.apply(notes, velocity, bpm)
+	} else {
+		for _, n := range notes {
+			events = append(events, Event{Note: n, Velocity: velocity})
+		}
+	}
+
+	if c.Echo != nil && c.Echo.Repeats > 0 {
+		events = c.Echo.apply(events, bpm)
+	}
+	return events
+}
+
+func chord(note uint8, sc *scale.Scale, steps []int) []uint8 {
+	root := note
+	if sc == nil {
+		// Transpose the major scale so the pressed note is its tonic.
+		sc = &scale.Scale{Root: int(note) % 12, Intervals: major.Intervals}
+	} else {
+		root = sc.Snap(note)
+	}
+	notes := make([]uint8, 0, len(steps))
+	for _, step := range steps {
+		notes = append(notes, sc.Step(root, step))
+	}
+	return notes
+}
+
+func (a *Arpeggio) apply(notes []uint8, velocity uint8, bpm float64) []Event {
+	octaves := a.Octaves
+	if octaves <= 0 {
+		octaves = 1
+	}
+	var seq []uint8
+	for o := 0; o < octaves; o++ {
+		for _, n := range notes {
+			if shifted := int(n) + 12*o; shifted <= 127 {
+				seq = append(seq, uint8(shifted))
+			}
+		}
+	}
+
+	switch a.Mode {
+	case "down":
+		for i, j := 0, len(seq)-1; i < j; i, j = i+1, j-1 {
+			seq[i], seq[j] = seq[j], seq[i]
+		}
+	case "updown":
+		for i := len(seq) - 2; i > 0; i-- {
+			seq = append(seq, seq[i])
+		}
+	case "random":
+		rand.Shuffle(len(seq), func(i, j int) { seq[i], seq[j] = seq[j], seq[i] })
+	}
+
+	beats, _ := quantize.ParseGrid(a.rate())
+	step := beatsToDuration(beats, bpm)
+	events := make([]Event, len(seq))
+	for i, n := range seq {
+		events[i] = Event{Offset: time.Duration(i) * step, Note: n, Velocity: velocity}
+	}
+	return events
+}
+
+func (e *Echo) apply(events []Event, bpm float64) []Event {
+	delay, err := e.delay(bpm)
+	if err != nil {
+		return events
+	}
+	decay := e.Decay
+	if decay <= 0 {
+		decay = 0.6
+	}
+
+	out := append([]Event(nil), events...)
+	for r := 1; r <= e.Repeats; r++ {
+		factor := math.Pow(decay, float64(r))
+		for _, ev := range events {
+			v := uint8(math.Round(float64(ev.Velocity) * factor))
+			if v == 0 {
+				continue
+			}
+			out = append(out, Event{
+				Offset:   ev.Offset + time.Duration(r)*delay,
+				Note:     ev.Note,
+				Velocity: v,
+			})
+		}
+	}
+	return out
+}
@@ -0,0 +1,84 @@
+package effects
+
+import (
+	"testing"
+	"time"
+
+	"github.com/radcliffetech/midi-lab/go/midi-server/internal/scale"
+)
+
+func notesOf(events []Event) []uint8 {
+	notes := make([]uint8, len(events))
+	for i, e := range events {
+		notes[i] = e.Note
+	}
+	return notes
+}
+
+func equalNotes(a, b []uint8) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestChordFollowsScale(t *testing.T) {
+	aMinor, _ := scale.Parse("A", "minor")
+	c := &Config{Chord: "seventh"}
+	got := notesOf(c.Apply(62, 100, aMinor, 120)) // D in A minor: D F A C
+	if want := []uint8{62, 65, 69, 72}; !equalNotes(got, want) {
+		t.Errorf("seventh on D = %v, want %v", got, want)
+	}
+
+	got = notesOf(c.Apply(62, 100, nil, 120)) // no scale: D major seventh
+	if want := []uint8{62, 66, 69, 73}; !equalNotes(got, want) {
+		t.Errorf("seventh on D without scale = %v, want %v", got, want)
+	}
+}
+
+func TestArpeggioSyncsToTempo(t *testing.T) {
+	c := &Config{Chord: "triad", Arpeggio: &Arpeggio{Mode: "updown", Rate: "1/8", Octaves: 1}}
+	events := c.Apply(60, 90, nil, 120)
+
+	if want := []uint8{60, 64, 67, 64}; !equalNotes(notesOf(events), want) {
+		t.Errorf("updown arpeggio = %v, want %v", notesOf(events), want)
+	}
+	// Eighths at 120 BPM are 250ms apart.
+	if events[3].Offset != 750*time.Millisecond {
+		t.Errorf("4th arpeggio step at %v, want 750ms", events[3].Offset)
+	}
+}
+
+func TestEchoDecays(t *testing.T) {
+	c := &Config{Echo: &Echo{Repeats: 2, Delay: "100ms", Decay: 0.5}}
+	events := c.Apply(60, 100, nil, 120)
+	if len(events) != 3 {
+		t.Fatalf("expected original plus 2 echoes, got %d", len(events))
+	}
+	if events[2].Offset != 200*time.Millisecond || events[2].Velocity != 25 {
+		t.Errorf("second echo = %+v, want 200ms at velocity 25", events[2])
+	}
+}
+
+func TestValidate(t *testing.T) {
+	bad := []*Config{
+		{Chord: "cluster"},
+		{Arpeggio: &Arpeggio{Mode: "sideways"}},
+		{Arpeggio: &Arpeggio{Rate: "1/7"}},
+		{Echo: &Echo{Repeats: 1, Delay: "soon"}},
+	}
+	for _, c := range bad {
+		if err := c.Validate(); err == nil {
+			t.Errorf("expected error for %+v", c)
+		}
+	}
+	good := &Config{Chord: "triad", Arpeggio: &Arpeggio{Mode: "random"}, Echo: &Echo{Repeats: 2, Delay: "1/8t"}}
+	if err := good.Validate(); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
@@ -0,0 +1,160 @@
+// Package groups partitions audience clients into sections, each with its
+// own pads, MIDI channel and color ("left side of the room plays bass").
+package groups
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+)
+
+type Mode string
+
+const (
+	// ModeRoundRobin deals clients into groups in turn.
+	ModeRoundRobin Mode = "round-robin"
+	// ModeSeat matches the seat code from the client URL against each
+	// group's seat prefixes, falling back to round-robin.
+	ModeSeat Mode = "seat"
+	// ModeAdmin leaves clients unassigned until an admin places them.
+	ModeAdmin Mode = "admin"
+)
+
+func ParseMode(s string) (Mode, error) {
+	switch m := Mode(s); m {
+	case ModeRoundRobin, ModeSeat, ModeAdmin:
+		return m, nil
+	}
+	return "", fmt.Errorf("unknown group mode %q", s)
+}
+
+type Group struct {
+	Name    string   `json:"name"`
+	Pads    []uint8  `json:"pads"`    // notes this group may play; empty means all
+	Channel uint8    `json:"channel"` // MIDI channel 1-16; 0 means channel 1
+	Color   string   `json:"color"`
+	Seats   []string `json:"seats"` // seat code prefixes, e.g. "A" matches seat "A12"
+}
+
+// MIDIChannel returns the zero-based channel used on the wire.
+func (g *Group) MIDIChannel() uint8 {
+	if g == nil || g.Channel == 0 {
+		return 0
+	}
+	return g.Channel - 1
+}
+
+// Allows reports whether a client in g may play note. A nil group (an
+// unassigned client) may play anything.
+func (g *Group) Allows(note uint8) bool {
+	if g == nil || len(g.Pads) == 0 {
+		return true
+	}
+	for _, p := range g.Pads {
+		if p == note {
+			return true
+		}
+	}
+	return false
+}
+
+// FilterLabels returns the subset of a scene's pad labels this group plays.
+func (g *Group) FilterLabels(labels map[uint8]string) map[uint8]string {
+	if g == nil || len(g.Pads) == 0 {
+		return labels
+	}
+	filtered := make(map[uint8]string, len(g.Pads))
+	for _, p := range g.Pads {
+		if label, ok := labels[p]; ok {
+			filtered[p] = label
+		}
+	}
+	return filtered
+}
+
+func (g *Group) matchesSeat(seat string) bool {
+	for _, prefix := range g.Seats {
+		if prefix != "" && strings.HasPrefix(strings.ToUpper(seat), strings.ToUpper(prefix)) {
+			return true
+		}
+	}
+	return false
+}
+
+func LoadFromFile(path string) ([]Group, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var loaded []Group
+	if err := json.NewDecoder(f).Decode(&loaded); err != nil {
+		return nil, err
+	}
+	for i, g := range loaded {
+		if g.Name == "" {
+			return nil, fmt.Errorf("group %d has no name", i)
+		}
+		if g.Channel > 16 {
+			return nil, fmt.Errorf("group %q: channel %d out of range 1-16", g.Name, g.Channel)
+		}
+	}
+	return loaded, nil
+}
+
+type Assigner struct {
+	mu     sync.Mutex
+	groups []Group
+	mode   Mode
+	next   int
+}
+
+func NewAssigner(groups []Group, mode Mode) *Assigner {
+	return &Assigner{groups: groups, mode: mode}
+}
+
+func (a *Assigner) Mode() Mode {
+	return a.mode
+}
+
+// Groups returns a copy of the configured groups.
+func (a *Assigner) Groups() []Group {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return append([]Group(nil), a.groups...)
+}
+
+// Assign picks a group for a newly connected client. It returns nil when
+// there are no groups or the mode is ModeAdmin.
+func (a *Assigner) Assign(seat string) *Group {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if len(a.groups) == 0 || a.mode == ModeAdmin {
+		return nil
+	}
+	if a.mode == ModeSeat && seat != "" {
+		for i := range a.groups {
+			if a.groups[i].matchesSeat(seat) {
+				return &a.groups[i]
+			}
+		}
+	}
+	g := &a.groups[a.next%len(a.groups)]
+	a.next++
+	return g
+}
+
+func (a *Assigner) Lookup(name string) (*Group, bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for i := range a.groups {
+		if a.groups[i].Name == name {
+			return &a.groups[i], true
+		}
+	}
+	return nil, false
+}
@@ -0,0 +1,56 @@
+package groups
+
+import "testing"
+
+var testGroups = []Group{
+	{Name: "bass", Pads: []uint8{60, 62}, Channel: 2, Seats: []string{"A"}},
+	{Name: "lead", Pads: []uint8{67, 69}, Channel: 3, Seats: []string{"B"}},
+}
+
+func TestRoundRobin(t *testing.T) {
+	a := NewAssigner(testGroups, ModeRoundRobin)
+	got := []string{a.Assign("").Name, a.Assign("").Name, a.Assign("").Name}
+	want := []string{"bass", "lead", "bass"}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("assignment %d = %s, want %s", i, got[i], want[i])
+		}
+	}
+}
+
+func TestSeatAssignment(t *testing.T) {
+	a := NewAssigner(testGroups, ModeSeat)
+	if g := a.Assign("b14"); g.Name != "lead" {
+		t.Errorf("seat b14 assigned to %s, want lead", g.Name)
+	}
+	if g := a.Assign("Z1"); g == nil {
+		t.Error("unknown seat should fall back to round-robin")
+	}
+}
+
+func TestAdminModeLeavesUnassigned(t *testing.T) {
+	a := NewAssigner(testGroups, ModeAdmin)
+	if g := a.Assign("A1"); g != nil {
+		t.Errorf("expected no group in admin mode, got %s", g.Name)
+	}
+	if g, ok := a.Lookup("lead"); !ok || g.MIDIChannel() != 2 {
+		t.Errorf("Lookup(lead) = %v, %v", g, ok)
+	}
+}
+
+func TestAllowsAndFilterLabels(t *testing.T) {
+	g := &testGroups[0]
+	if !g.Allows(60) || g.Allows(67) {
+		t.Error("bass should allow 60 and reject 67")
+	}
+	var unassigned *Group
+	if !unassigned.Allows(67) {
+		t.Error("unassigned clients may play any pad")
+	}
+
+	labels := map[uint8]string{60: "C", 62: "D", 67: "G"}
+	filtered := g.FilterLabels(labels)
+	if len(filtered) != 2 || filtered[60] != "C" || filtered[62] != "D" {
+		t.Errorf("unexpected filtered labels: %v", filtered)
+	}
+}
@@ -0,0 +1,209 @@
+// Package journal records hub activity as JSON lines, one event per line,
+// rotating the file when it grows too large or too old.
+package journal
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+type Level int
+
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+var levelNames = map[Level]string{
+	LevelDebug: "debug",
+	LevelInfo:  "info",
+	LevelWarn:  "warn",
+	LevelError: "error",
+}
+
+func (l Level) String() string {
+	if name, ok := levelNames[l]; ok {
+		return name
+	}
+	return fmt.Sprintf("level(%d)", int(l))
+}
+
+func (l Level) MarshalJSON() ([]byte, error) {
+	return json.Marshal(l.String())
+}
+
+// ParseLevel converts a level name such as "info" or "warn" into a Level.
+func ParseLevel(s string) (Level, error) {
+	for l, name := range levelNames {
+		if strings.EqualFold(s, name) {
+			return l, nil
+		}
+	}
+	return LevelInfo, fmt.Errorf("unknown log level %q", s)
+}
+
+// Entry is a single journal line. Note and Velocity are pointers so that
+// note 0 is distinguishable from "no note".
+type Entry struct {
+	Time     time.Time `json:"ts"`
+	Level    Level     `json:"level"`
+	Event    string    `json:"event"`
+	ClientID string    `json:"client_id,omitempty"`
+	Note     *uint8    `json:"note,omitempty"`
+	Velocity *uint8    `json:"velocity,omitempty"`
+	Scene    string    `json:"scene,omitempty"`
+	Message  string    `json:"msg,omitempty"`
+}
+
+type Options struct {
+	Path    string
+	MaxSize int64         // rotate once the file reaches this many bytes; 0 disables
+	MaxAge  time.Duration // rotate once the file has been open this long; 0 disables
+	Level   Level         // entries below this level are discarded
+}
+
+// rotateRetry is how long the journal waits after a failed rotation
+// before trying again.
+const rotateRetry = time.Minute
+
+type Journal struct {
+	mu      sync.Mutex
+	opts    Options
+	file    *os.File
+	size    int64
+	opened  time.Time
+	retryAt time.Time // no rotation before this, after one failed
+	failing bool      // rotation is failing and that has been reported
+	now     func() time.Time
+}
+
+// Open opens (or appends to) the journal file at opts.Path.
+func Open(opts Options) (*Journal, error) {
+	j := &Journal{opts: opts, now: time.Now}
+	if err := j.open(); err != nil {
+		return nil, err
+	}
+	return j, nil
+}
+
+func (j *Journal) open() error {
+	f, err := os.OpenFile(j.opts.Path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	j.file = f
+	j.size = info.Size()
+	j.opened = j.now()
+	return nil
+}
+
+// Log writes e to the journal. A nil Journal discards everything, so callers
+// don't need to check whether journaling is enabled.
+func (j *Journal) Log(e Entry) error {
+	if j == nil {
+		return nil
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if e.Level < j.opts.Level || j.file == nil {
+		return nil
+	}
+	if e.Time.IsZero() {
+		e.Time = j.now()
+	}
+
+	line, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	// A failed rotation is reported once and retried after rotateRetry;
+	// the entry is still written to whichever file is open.
+	var rotateErr error
+	if j.shouldRotate(int64(len(line))) {
+		if err := j.rotate(); err != nil {
+			j.retryAt = j.now().Add(rotateRetry)
+			if !j.failing {
+				rotateErr = err
+			}
+			j.failing = true
+		} else {
+			j.failing = false
+		}
+	}
+	if j.file == nil {
+		return rotateErr
+	}
+
+	n, err := j.file.Write(line)
+	j.size += int64(n)
+	if err == nil {
+		err = rotateErr
+	}
+	return err
+}
+
+func (j *Journal) shouldRotate(next int64) bool {
+	if j.size == 0 || j.now().Before(j.retryAt) {
+		return false
+	}
+	if j.opts.MaxSize > 0 && j.size+next > j.opts.MaxSize {
+		return true
+	}
+	if j.opts.MaxAge > 0 && j.now().Sub(j.opened) >= j.opts.MaxAge {
+		return true
+	}
+	return false
+}
+
+// rotate moves the current file aside as <path>.<timestamp> and starts a new one.
+// If the file can't be moved it is opened again, so logging carries on in it.
+func (j *Journal) rotate() error {
+	err := j.file.Close()
+	j.file = nil
+	if err == nil {
+		base := j.opts.Path + "." + j.now().Format("20060102-150405")
+		target := base
+		for i := 1; ; i++ {
+			if _, err := os.Stat(target); os.IsNotExist(err) {
+				break
+			}
+			target = fmt.Sprintf("%s.%d", base, i)
+		}
+		err = os.Rename(j.opts.Path, target)
+	}
+	if openErr := j.open(); openErr != nil {
+		return openErr
+	}
+	if err != nil {
+		return fmt.Errorf("rotate journal: %v", err)
+	}
+	return nil
+}
+
+func (j *Journal) Close() error {
+	if j == nil {
+		return nil
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.file == nil {
+		return nil
+	}
+	err := j.file.Close()
+	j.file = nil
+	return err
+}
@@ -0,0 +1,155 @@
+package journal
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func readLines(t *testing.T, path string) []map[string]interface{} {
+	t.Helper()
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("open %s: %v", path, err)
+	}
+	defer f.Close()
+
+	var lines []map[string]interface{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var m map[string]interface{}
+		if err := json.Unmarshal(scanner.Bytes(), &m); err != nil {
+			t.Fatalf("invalid JSON line %q: %v", scanner.Text(), err)
+		}
+		lines = append(lines, m)
+	}
+	return lines
+}
+
+func TestLogWritesJSONLines(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "hub.jsonl")
+	j, err := Open(Options{Path: path, Level: LevelInfo})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	note := uint8(60)
+	j.Log(Entry{Level: LevelInfo, Event: "note", ClientID: "abc", Note: &note, Scene: "Intro"})
+	j.Log(Entry{Level: LevelDebug, Event: "ignored"})
+	j.Close()
+
+	lines := readLines(t, path)
+	if len(lines) != 1 {
+		t.Fatalf("expected 1 line, got %d", len(lines))
+	}
+	if lines[0]["event"] != "note" || lines[0]["client_id"] != "abc" || lines[0]["note"] != float64(60) || lines[0]["level"] != "info" {
+		t.Errorf("unexpected entry: %v", lines[0])
+	}
+}
+
+func TestRotatesOnSize(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "hub.jsonl")
+	j, err := Open(Options{Path: path, MaxSize: 200})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		j.Log(Entry{Level: LevelInfo, Event: "connect", ClientID: "client"})
+	}
+	j.Close()
+
+	matches, _ := filepath.Glob(path + ".*")
+	if len(matches) == 0 {
+		t.Fatal("expected rotated files")
+	}
+	info, _ := os.Stat(path)
+	if info.Size() > 200 {
+		t.Errorf("active journal is %d bytes, expected <= 200", info.Size())
+	}
+}
+
+func TestRotatesOnAge(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "hub.jsonl")
+	j, err := Open(Options{Path: path, MaxAge: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Date(2025, 1, 1, 12, 0, 0, 0, time.UTC)
+	j.now = func() time.Time { return now }
+	j.opened = now
+
+	j.Log(Entry{Level: LevelInfo, Event: "scene"})
+	now = now.Add(2 * time.Hour)
+	j.Log(Entry{Level: LevelInfo, Event: "scene"})
+	j.Close()
+
+	if _, err := os.Stat(path + ".20250101-140000"); err != nil {
+		t.Errorf("expected rotated file: %v", err)
+	}
+	if lines := readLines(t, path); len(lines) != 1 {
+		t.Errorf("expected 1 line in active journal, got %d", len(lines))
+	}
+}
+
+func TestKeepsLoggingWhenRotationFails(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "hub.jsonl")
+	j, err := Open(Options{Path: path, MaxSize: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Date(2025, 1, 1, 12, 0, 0, 0, time.UTC)
+	j.now = func() time.Time { return now }
+	if err := j.Log(Entry{Level: LevelInfo, Event: "connect"}); err != nil {
+		t.Fatal(err)
+	}
+	// Whoever removed the file also broke the rename.
+	os.Remove(path)
+
+	if err := j.Log(Entry{Level: LevelInfo, Event: "scene"}); err == nil {
+		t.Error("failed rotation was not reported")
+	}
+	if lines := readLines(t, path); len(lines) != 1 || lines[0]["event"] != "scene" {
+		t.Errorf("expected the entry in the reopened journal, got %v", lines)
+	}
+
+	// Until rotateRetry has passed, entries go on the current file
+	// without another attempt, even one that would fail.
+	os.Remove(path)
+	if err := j.Log(Entry{Level: LevelInfo, Event: "note"}); err != nil {
+		t.Errorf("log while backing off: %v", err)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Error("rotation was retried before rotateRetry")
+	}
+
+	// The next failure in the same run is not reported again.
+	now = now.Add(rotateRetry)
+	if err := j.Log(Entry{Level: LevelInfo, Event: "note"}); err != nil {
+		t.Errorf("repeated rotation failure reported: %v", err)
+	}
+	if _, err := os.Stat(path); err != nil {
+		t.Errorf("rotation was not retried after rotateRetry: %v", err)
+	}
+
+	now = now.Add(rotateRetry)
+	if err := j.Log(Entry{Level: LevelInfo, Event: "note"}); err != nil {
+		t.Errorf("rotation after recovery: %v", err)
+	}
+	j.Close()
+	if matches, _ := filepath.Glob(path + ".*"); len(matches) != 1 {
+		t.Errorf("expected one rotated file once the rename works, got %v", matches)
+	}
+}
+
+func TestParseLevel(t *testing.T) {
+	if l, err := ParseLevel("WARN"); err != nil || l != LevelWarn {
+		t.Errorf("ParseLevel(WARN) = %v, %v", l, err)
+	}
+	if _, err := ParseLevel("loud"); err == nil {
+		t.Error("expected error for unknown level")
+	}
+}
@@ -0,0 +1,372 @@
+// Package osc bridges the hub to Open Sound Control over UDP, for venues
+// that drive lighting and visuals with OSC rather than MIDI. It covers the
+// subset of OSC 1.0 those rigs use: messages with int32, float32 and string
+// arguments, and incoming bundles.
+package osc
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"os"
+	"strings"
+)
+
+// Message is a single OSC message. Args may hold int32, float32 and string
+// values; int and float64 are converted when encoding.
+type Message struct {
+	Address string
+	Args    []interface{}
+}
+
+// MarshalBinary encodes m as an OSC packet.
+func (m Message) MarshalBinary() ([]byte, error) {
+	if !strings.HasPrefix(m.Address, "/") {
+		return nil, fmt.Errorf("osc address %q must start with /", m.Address)
+	}
+	var buf bytes.Buffer
+	writeString(&buf, m.Address)
+
+	tags := []byte{','}
+	var args bytes.Buffer
+	for _, a := range m.Args {
+		switch v := a.(type) {
+		case int32:
+			tags = append(tags, 'i')
+			binary.Write(&args, binary.BigEndian, v)
+		case int:
+			tags = append(tags, 'i')
+			binary.Write(&args, binary.BigEndian, int32(v))
+		case float32:
+			tags = append(tags, 'f')
+			binary.Write(&args, binary.BigEndian, math.Float32bits(v))
+		case float64:
+			tags = append(tags, 'f')
+			binary.Write(&args, binary.BigEndian, math.Float32bits(float32(v)))
+		case string:
+			tags = append(tags, 's')
+			writeString(&args, v)
+		default:
+			return nil, fmt.Errorf("osc: unsupported argument type %T", a)
+		}
+	}
+	writeString(&buf, string(tags))
+	buf.Write(args.Bytes())
+	return buf.Bytes(), nil
+}
+
+// writeString writes s null-terminated and padded to a multiple of 4 bytes.
+func writeString(buf *bytes.Buffer, s string) {
+	buf.WriteString(s)
+	buf.Write(make([]byte, 4-len(s)%4))
+}
+
+// Parse decodes an OSC packet. Bundles are flattened into their messages;
+// time tags are ignored and everything is handled on arrival.
+func Parse(b []byte) ([]Message, error) {
+	if bytes.HasPrefix(b, []byte("#bundle\x00")) {
+		if len(b) < 16 {
+			return nil, errors.New("osc: short bundle")
+		}
+		var msgs []Message
+		rest := b[16:]
+		for len(rest) > 0 {
+			if len(rest) < 4 {
+				return nil, errors.New("osc: truncated bundle element")
+			}
+			size := int(binary.BigEndian.Uint32(rest))
+			if size > len(rest)-4 {
+				return nil, errors.New("osc: bundle element overruns packet")
+			}
+			inner, err := Parse(rest[4 : 4+size])
+			if err != nil {
+				return nil, err
+			}
+			msgs = append(msgs, inner...)
+			rest = rest[4+size:]
+		}
+		return msgs, nil
+	}
+
+	address, rest, err := readString(b)
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasPrefix(address, "/") {
+		return nil, fmt.Errorf("osc: bad address %q", address)
+	}
+	m := Message{Address: address}
+	if len(rest) == 0 {
+		return []Message{m}, nil // older senders omit the type tag string
+	}
+	tags, rest, err := readString(rest)
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasPrefix(tags, ",") {
+		return nil, fmt.Errorf("osc: bad type tags %q", tags)
+	}
+	for _, tag := range tags[1:] {
+		switch tag {
+		case 'i', 'f':
+			if len(rest) < 4 {
+				return nil, errors.New("osc: truncated argument")
+			}
+			bits := binary.BigEndian.Uint32(rest)
+			rest = rest[4:]
+			if tag == 'i' {
+				m.Args = append(m.Args, int32(bits))
+			} else {
+				m.Args = append(m.Args, math.Float32frombits(bits))
+			}
+		case 's':
+			var s string
+			s, rest, err = readString(rest)
+			if err != nil {
+				return nil, err
+			}
+			m.Args = append(m.Args, s)
+		default:
+			return nil, fmt.Errorf("osc: unsupported type tag %q", tag)
+		}
+	}
+	return []Message{m}, nil
+}
+
+func readString(b []byte) (string, []byte, error) {
+	end := bytes.IndexByte(b, 0)
+	if end < 0 {
+		return "", nil, errors.New("osc: unterminated string")
+	}
+	padded := (end/4 + 1) * 4
+	if padded > len(b) {
+		return "", nil, errors.New("osc: string padding overruns packet")
+	}
+	return string(b[:end]), b[padded:], nil
+}
+
+// Int returns argument i as an int, accepting int32 or float32 since many
+// lighting desks only send floats. ok is false if it is missing or a string.
+func (m Message) Int(i int) (n int, ok bool) {
+	if i >= len(m.Args) {
+		return 0, false
+	}
+	switch v := m.Args[i].(type) {
+	case int32:
+		return int(v), true
+	case float32:
+		return int(math.Round(float64(v))), true
+	}
+	return 0, false
+}
+
+// Addresses are the OSC addresses the bridge sends and answers to.
+type Addresses struct {
+	Note    string `json:"note"`    // channel, note, velocity (velocity 0 is note off)
+	Scene   string `json:"scene"`   // scene number (1-based), cue text
+	Control string `json:"control"` // channel, controller, value
+}
+
+// DefaultAddresses are used for any address left empty in a config file.
+var DefaultAddresses = Addresses{
+	Note:    "/midi/note",
+	Scene:   "/midi/scene",
+	Control: "/midi/cc",
+}
+
+// LoadAddresses reads an address map from a JSON file, filling gaps from
+// DefaultAddresses.
+func LoadAddresses(path string) (Addresses, error) {
+	a := DefaultAddresses
+	f, err := os.Open(path)
+	if err != nil {
+		return a, err
+	}
+	defer f.Close()
+	if err := json.NewDecoder(f).Decode(&a); err != nil {
+		return a, err
+	}
+	for _, addr := range []string{a.Note, a.Scene, a.Control} {
+		if !strings.HasPrefix(addr, "/") {
+			return a, fmt.Errorf("osc address %q must start with /", addr)
+		}
+	}
+	return a, nil
+}
+
+// Sender emits hub events as OSC. A nil Sender does nothing, so callers
+// don't need to check whether OSC output is enabled.
+type Sender struct {
+	conn  net.Conn
+	addrs Addresses
+}
+
+// Dial opens a UDP sender to host:port.
+func Dial(target string, addrs Addresses) (*Sender, error) {
+	conn, err := net.Dial("udp", target)
+	if err != nil {
+		return nil, err
+	}
+	return &Sender{conn: conn, addrs: addrs}, nil
+}
+
+func (s *Sender) Send(m Message) error {
+	if s == nil {
+		return nil
+	}
+	b, err := m.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	_, err = s.conn.Write(b)
+	return err
+}
+
+func (s *Sender) Note(channel, note, velocity uint8) error {
+	if s == nil {
+		return nil
+	}
+	return s.Send(Message{Address: s.addrs.Note, Args: []interface{}{int32(channel) + 1, int32(note), int32(velocity)}})
+}
+
+func (s *Sender) Scene(number int, cue string) error {
+	if s == nil {
+		return nil
+	}
+	return s.Send(Message{Address: s.addrs.Scene, Args: []interface{}{int32(number), cue}})
+}
+
+func (s *Sender) Control(channel, controller, value uint8) error {
+	if s == nil {
+		return nil
+	}
+	return s.Send(Message{Address: s.addrs.Control, Args: []interface{}{int32(channel) + 1, int32(controller), int32(value)}})
+}
+
+func (s *Sender) Close() error {
+	if s == nil {
+		return nil
+	}
+	return s.conn.Close()
+}
+
+// Handlers receive OSC input. Channels are 0-based, as on the MIDI side.
+type Handlers struct {
+	// Note plays a note. Messages carry channel, note, velocity, or just
+	// note, velocity for channel 1.
+	Note func(channel, note, velocity uint8)
+	// Scene jumps to a 1-based scene number, or advances to the next scene
+	// when number is 0 (a message with no arguments).
+	Scene func(number int)
+	// Unknown is called for messages on other addresses, or with bad
+	// arguments. Optional.
+	Unknown func(m Message)
+}
+
+// Listener receives OSC over UDP and calls the matching handler.
+type Listener struct {
+	conn     net.PacketConn
+	addrs    Addresses
+	handlers Handlers
+}
+
+func Listen(addr string, addrs Addresses, h Handlers) (*Listener, error) {
+	conn, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return &Listener{conn: conn, addrs: addrs, handlers: h}, nil
+}
+
+// Addr returns the local address, useful when listening on port 0.
+func (l *Listener) Addr() net.Addr {
+	return l.conn.LocalAddr()
+}
+
+// Serve reads packets until ctx is done or the listener is closed.
+func (l *Listener) Serve(ctx context.Context) error {
+	go func() {
+		<-ctx.Done()
+		l.conn.Close()
+	}()
+	buf := make([]byte, 65536)
+	for {
+		n, _, err := l.conn.ReadFrom(buf)
+		if err != nil {
+			if ctx.Err() != nil || errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+		msgs, err := Parse(buf[:n])
+		if err != nil {
+			continue // not OSC, or a dialect we don't speak
+		}
+		for _, m := range msgs {
+			l.handle(m)
+		}
+	}
+}
+
+func (l *Listener) handle(m Message) {
+	switch m.Address {
+	case l.addrs.Note:
+		if l.handlers.Note == nil {
+			return
+		}
+		args := make([]int, 0, 3)
+		for i := range m.Args {
+			n, ok := m.Int(i)
+			if !ok || n < 0 || n > 127 {
+				l.unknown(m)
+				return
+			}
+			args = append(args, n)
+		}
+		switch len(args) {
+		case 2:
+			l.handlers.Note(0, uint8(args[0]), uint8(args[1]))
+		case 3:
+			if args[0] < 1 || args[0] > 16 {
+				l.unknown(m)
+				return
+			}
+			l.handlers.Note(uint8(args[0]-1), uint8(args[1]), uint8(args[2]))
+		default:
+			l.unknown(m)
+		}
+
+	case l.addrs.Scene:
+		if l.handlers.Scene == nil {
+			return
+		}
+		if len(m.Args) == 0 {
+			l.handlers.Scene(0)
+			return
+		}
+		n, ok := m.Int(0)
+		if !ok || n < 1 {
+			l.unknown(m)
+			return
+		}
+		l.handlers.Scene(n)
+
+	default:
+		l.unknown(m)
+	}
+}
+
+func (l *Listener) unknown(m Message) {
+	if l.handlers.Unknown != nil {
+		l.handlers.Unknown(m)
+	}
+}
+
+func (l *Listener) Close() error {
+	return l.conn.Close()
+}
@@ -0,0 +1,157 @@
+package osc
+
+import (
+	"context"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestRoundTrip(t *testing.T) {
+	in := Message{Address: "/midi/scene", Args: []interface{}{int32(3), "Chorus", float32(0.5)}}
+	b, err := in.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(b)%4 != 0 {
+		t.Errorf("packet length %d is not a multiple of 4", len(b))
+	}
+	out, err := Parse(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(out) != 1 || !reflect.DeepEqual(out[0], in) {
+		t.Errorf("round trip = %+v, want %+v", out, in)
+	}
+}
+
+func TestParseBundle(t *testing.T) {
+	a, _ := Message{Address: "/a", Args: []interface{}{int32(1)}}.MarshalBinary()
+	b, _ := Message{Address: "/b"}.MarshalBinary()
+
+	packet := append([]byte("#bundle\x00"), make([]byte, 8)...) // immediate time tag
+	for _, elem := range [][]byte{a, b} {
+		packet = append(packet, 0, 0, 0, byte(len(elem)))
+		packet = append(packet, elem...)
+	}
+
+	msgs, err := Parse(packet)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(msgs) != 2 || msgs[0].Address != "/a" || msgs[1].Address != "/b" {
+		t.Errorf("unexpected bundle contents: %+v", msgs)
+	}
+}
+
+func TestParseRejectsGarbage(t *testing.T) {
+	for _, b := range [][]byte{
+		[]byte("not osc"),
+		[]byte("/x\x00\x00,i\x00\x00"), // int tag with no data
+		[]byte("#bundle\x00"),
+	} {
+		if _, err := Parse(b); err == nil {
+			t.Errorf("expected error for %q", b)
+		}
+	}
+}
+
+func TestSenderWritesToUDP(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	s, err := Dial(conn.LocalAddr().String(), DefaultAddresses)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	if err := s.Note(1, 60, 100); err != nil {
+		t.Fatal(err)
+	}
+
+	buf := make([]byte, 1024)
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	n, _, err := conn.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msgs, err := Parse(buf[:n])
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := Message{Address: "/midi/note", Args: []interface{}{int32(2), int32(60), int32(100)}}
+	if !reflect.DeepEqual(msgs[0], want) {
+		t.Errorf("received %+v, want %+v", msgs[0], want)
+	}
+
+	var nilSender *Sender
+	if err := nilSender.Scene(1, "x"); err != nil {
+		t.Errorf("nil sender should be a no-op, got %v", err)
+	}
+}
+
+func TestListenerDispatches(t *testing.T) {
+	type note struct{ ch, note, vel uint8 }
+	notes := make(chan note, 4)
+	scenes := make(chan int, 4)
+	unknown := make(chan string, 4)
+
+	l, err := Listen("127.0.0.1:0", DefaultAddresses, Handlers{
+		Note:    func(ch, n, v uint8) { notes <- note{ch, n, v} },
+		Scene:   func(n int) { scenes <- n },
+		Unknown: func(m Message) { unknown <- m.Address },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go l.Serve(ctx)
+
+	s, err := Dial(l.Addr().String(), DefaultAddresses)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	s.Send(Message{Address: "/midi/note", Args: []interface{}{int32(3), int32(64), float32(90)}})
+	s.Send(Message{Address: "/midi/note", Args: []interface{}{int32(60), int32(80)}})
+	s.Send(Message{Address: "/midi/scene"})
+	s.Send(Message{Address: "/midi/scene", Args: []interface{}{int32(4)}})
+	s.Send(Message{Address: "/lights/dim", Args: []interface{}{float32(1)}})
+
+	timeout := time.After(time.Second)
+	expect := func(got interface{}, want interface{}) {
+		t.Helper()
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("got %+v, want %+v", got, want)
+		}
+	}
+	for _, want := range []note{{2, 64, 90}, {0, 60, 80}} {
+		select {
+		case got := <-notes:
+			expect(got, want)
+		case <-timeout:
+			t.Fatal("timed out waiting for note")
+		}
+	}
+	for _, want := range []int{0, 4} {
+		select {
+		case got := <-scenes:
+			expect(got, want)
+		case <-timeout:
+			t.Fatal("timed out waiting for scene")
+		}
+	}
+	select {
+	case got := <-unknown:
+		expect(got, "/lights/dim")
+	case <-timeout:
+		t.Fatal("timed out waiting for unknown message")
+	}
+}
@@ -0,0 +1,88 @@
+// Package quantize snaps note times onto a tempo grid so that audience
+// presses, which arrive with network jitter, land on the beat.
+package quantize
+
+import (
+	"fmt"
+	"math"
+	"sync"
+	"time"
+)
+
+// grids maps grid names to their length in beats (quarter notes).
+var grids = map[string]float64{
+	"1/4":   1,
+	"1/8":   1.0 / 2,
+	"1/16":  1.0 / 4,
+	"1/32":  1.0 / 8,
+	"1/4t":  2.0 / 3,
+	"1/8t":  1.0 / 3,
+	"1/16t": 1.0 / 6,
+}
+
+// ParseGrid converts a grid name such as "1/16" or "1/8t" (triplets) into
+// its length in beats.
+func ParseGrid(name string) (float64, error) {
+	if beats, ok := grids[name]; ok {
+		return beats, nil
+	}
+	return 0, fmt.Errorf("unknown grid %q (want 1/4, 1/8, 1/16, 1/32, 1/4t, 1/8t or 1/16t)", name)
+}
+
+type Quantizer struct {
+	mu     sync.Mutex
+	bpm    float64
+	grid   float64   // grid length in beats
+	origin time.Time // a moment known to fall on a beat
+}
+
+func New(bpm, gridBeats float64) *Quantizer {
+	return &Quantizer{bpm: bpm, grid: gridBeats, origin: time.Now()}
+}
+
+func (q *Quantizer) Tempo() float64 {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.bpm
+}
+
+func (q *Quantizer) SetTempo(bpm float64) {
+	if bpm <= 0 {
+		return
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.bpm = bpm
+}
+
+// Align moves the grid so that a beat falls at t, e.g. when a beat arrives
+// from an external clock.
+func (q *Quantizer) Align(t time.Time) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.origin = t
+}
+
+// Step returns the length of one grid division at the current tempo.
+func (q *Quantizer) Step() time.Duration {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.step()
+}
+
+func (q *Quantizer) step() time.Duration {
+	return time.Duration(float64(time.Minute) / q.bpm * q.grid)
+}
+
+// Next returns the first grid point at or after t.
+func (q *Quantizer) Next(t time.Time) time.Time {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	step := q.step()
+	if step <= 0 {
+		return t
+	}
+	n := math.Ceil(float64(t.Sub(q.origin)) / float64(step))
+	return q.origin.Add(time.Duration(n) * step)
+}
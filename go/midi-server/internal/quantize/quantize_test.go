@@ -0,0 +1,58 @@
+package quantize
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseGrid(t *testing.T) {
+	cases := map[string]float64{"1/8": 0.5, "1/16": 0.25, "1/8t": 1.0 / 3}
+	for name, want := range cases {
+		got, err := ParseGrid(name)
+		if err != nil || got != want {
+			t.Errorf("ParseGrid(%q) = %v, %v; want %v", name, got, err, want)
+		}
+	}
+	if _, err := ParseGrid("1/5"); err == nil {
+		t.Error("expected error for unknown grid")
+	}
+}
+
+func TestNextSnapsToGrid(t *testing.T) {
+	// 120 BPM sixteenths: one grid point every 125ms.
+	q := New(120, 0.25)
+	origin := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	q.Align(origin)
+
+	if step := q.Step(); step != 125*time.Millisecond {
+		t.Fatalf("Step() = %v, want 125ms", step)
+	}
+
+	cases := []struct {
+		in, want time.Duration
+	}{
+		{0, 0},
+		{1 * time.Millisecond, 125 * time.Millisecond},
+		{124 * time.Millisecond, 125 * time.Millisecond},
+		{125 * time.Millisecond, 125 * time.Millisecond},
+		{300 * time.Millisecond, 375 * time.Millisecond},
+	}
+	for _, c := range cases {
+		if got := q.Next(origin.Add(c.in)).Sub(origin); got != c.want {
+			t.Errorf("Next(+%v) = +%v, want +%v", c.in, got, c.want)
+		}
+	}
+}
+
+func TestTripletGridFollowsTempo(t *testing.T) {
+	q := New(120, 1.0/3)
+	origin := time.Now()
+	q.Align(origin)
+	q.SetTempo(60)
+
+	// At 60 BPM eighth-note triplets are a third of a second apart.
+	want := time.Second / 3
+	if got := q.Next(origin.Add(10 * time.Millisecond)).Sub(origin); got != want {
+		t.Errorf("Next = +%v, want +%v", got, want)
+	}
+}
@@ -0,0 +1,110 @@
+// Package relay streams the hub's raw MIDI output to "host" WebSocket
+// clients, browser tabs that play it through Web MIDI or a WebAudio synth,
+// so the server itself needs no MIDI or audio hardware.
+package relay
+
+import (
+	"sync"
+	"time"
+)
+
+// Frame is one MIDI message as sent to a host.
+type Frame struct {
+	Type string `json:"type"` // always "midi"
+	Data []int  `json:"data"` // status and data bytes
+	// At is when the server emitted the message, in Unix milliseconds with
+	// sub-millisecond precision, so hosts can keep the original timing.
+	At float64 `json:"at"`
+}
+
+// Host is a connected host client. Its queue is buffered so clock pulses
+// and note bursts don't have to wait for the socket.
+type Host struct {
+	ID   string
+	Send chan interface{}
+}
+
+func NewHost(id string, depth int) *Host {
+	return &Host{ID: id, Send: make(chan interface{}, depth)}
+}
+
+type Stats struct {
+	Hosts   int    `json:"hosts"`
+	Sent    uint64 `json:"sent"`
+	Dropped uint64 `json:"dropped"`
+}
+
+// Relay fans MIDI out to every registered host. A nil Relay does nothing.
+type Relay struct {
+	mu      sync.RWMutex
+	hosts   map[*Host]struct{}
+	sent    uint64
+	dropped uint64
+	now     func() time.Time
+}
+
+func New() *Relay {
+	return &Relay{hosts: make(map[*Host]struct{}), now: time.Now}
+}
+
+func (r *Relay) Add(h *Host) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.hosts[h] = struct{}{}
+}
+
+// Remove unregisters h and closes its queue. It is safe to call twice.
+func (r *Relay) Remove(h *Host) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.hosts[h]; ok {
+		delete(r.hosts, h)
+		close(h.Send)
+	}
+}
+
+func (r *Relay) Len() int {
+	if r == nil {
+		return 0
+	}
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return len(r.hosts)
+}
+
+// Send queues msgs for every host. A host whose queue is full misses the
+// message rather than holding up the hub; it is counted as dropped.
+func (r *Relay) Send(msgs ...[]byte) error {
+	if r == nil {
+		return nil
+	}
+	at := float64(r.now().UnixMicro()) / 1000
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, m := range msgs {
+		data := make([]int, len(m))
+		for i, b := range m {
+			data[i] = int(b)
+		}
+		frame := Frame{Type: "midi", Data: data, At: at}
+		for h := range r.hosts {
+			select {
+			case h.Send <- frame:
+				r.sent++
+			default:
+				r.dropped++
+			}
+		}
+	}
+	return nil
+}
+
+func (r *Relay) Stats() Stats {
+	if r == nil {
+		return Stats{}
+	}
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return Stats{Hosts: len(r.hosts), Sent: r.sent, Dropped: r.dropped}
+}
@@ -0,0 +1,66 @@
+package relay
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestSendToHosts(t *testing.T) {
+	r := New()
+	r.now = func() time.Time { return time.UnixMicro(1_700_000_000_123_456) }
+	a, b := NewHost("a", 4), NewHost("b", 4)
+	r.Add(a)
+	r.Add(b)
+
+	r.Send([]byte{0x90, 60, 100}, []byte{0xF8})
+
+	want := []Frame{
+		{Type: "midi", Data: []int{0x90, 60, 100}, At: 1_700_000_000_123.456},
+		{Type: "midi", Data: []int{0xF8}, At: 1_700_000_000_123.456},
+	}
+	for _, h := range []*Host{a, b} {
+		for _, w := range want {
+			if got := <-h.Send; !reflect.DeepEqual(got, w) {
+				t.Errorf("host %s got %+v, want %+v", h.ID, got, w)
+			}
+		}
+	}
+	if s := r.Stats(); s.Hosts != 2 || s.Sent != 4 || s.Dropped != 0 {
+		t.Errorf("unexpected stats %+v", s)
+	}
+}
+
+func TestFullHostDropsInsteadOfBlocking(t *testing.T) {
+	r := New()
+	h := NewHost("slow", 1)
+	r.Add(h)
+
+	r.Send([]byte{0xF8})
+	r.Send([]byte{0xF8})
+
+	if s := r.Stats(); s.Sent != 1 || s.Dropped != 1 {
+		t.Errorf("unexpected stats %+v", s)
+	}
+}
+
+func TestRemoveClosesQueue(t *testing.T) {
+	r := New()
+	h := NewHost("gone", 1)
+	r.Add(h)
+	r.Remove(h)
+	r.Remove(h)
+
+	if _, ok := <-h.Send; ok {
+		t.Error("queue should be closed after Remove")
+	}
+	r.Send([]byte{0xF8}) // must not panic on the closed queue
+	if r.Len() != 0 {
+		t.Errorf("Len = %d, want 0", r.Len())
+	}
+
+	var none *Relay
+	if err := none.Send([]byte{0xF8}); err != nil || none.Len() != 0 {
+		t.Error("nil relay should be a no-op")
+	}
+}
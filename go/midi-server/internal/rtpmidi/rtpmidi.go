@@ -0,0 +1,568 @@
+// Package rtpmidi implements enough of RTP-MIDI (RFC 6295) and Apple's
+// session protocol to exchange MIDI with DAWs over the LAN: invitations,
+// clock sync, bye, and MIDI command sections without a recovery journal.
+//
+// A session binds two UDP ports, control and data (control+1), as Apple's
+// Network MIDI does.
+package rtpmidi
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	protocolVersion = 2
+	payloadType     = 0x61
+	syncInterval    = 10 * time.Second
+	inviteTimeout   = 2 * time.Second
+	inviteRetries   = 3
+)
+
+var signature = []byte{0xFF, 0xFF}
+
+// Session commands.
+const (
+	cmdInvitation = "IN"
+	cmdAccept     = "OK"
+	cmdReject     = "NO"
+	cmdBye        = "BY"
+	cmdSync       = "CK"
+	cmdFeedback   = "RS"
+)
+
+// Peer is a remote participant in the session.
+type Peer struct {
+	Name    string
+	SSRC    uint32
+	Control *net.UDPAddr
+	Data    *net.UDPAddr
+	Latency time.Duration // one-way estimate from the last clock sync
+
+	initiated bool // we invited them, so we drive clock sync
+}
+
+// Session is a local RTP-MIDI endpoint.
+type Session struct {
+	Name string
+
+	// OnMIDI is called with each complete MIDI message received from a
+	// peer. Set it before Serve.
+	OnMIDI func(msg []byte, from Peer)
+
+	ssrc    uint32
+	start   time.Time
+	control *net.UDPConn
+	data    *net.UDPConn
+
+	mu      sync.Mutex
+	peers   map[uint32]*Peer
+	pending map[uint32]chan packet // invitations awaiting a reply, by token
+	seq     uint16
+}
+
+// Listen binds the control port at addr and the data port one above it.
+// With port 0 a free pair is chosen.
+func Listen(name, addr string) (*Session, error) {
+	base, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	var control, data *net.UDPConn
+	for attempt := 0; attempt < 10; attempt++ {
+		control, err = net.ListenUDP("udp", base)
+		if err != nil {
+			return nil, err
+		}
+		local := control.LocalAddr().(*net.UDPAddr)
+		data, err = net.ListenUDP("udp", &net.UDPAddr{IP: base.IP, Port: local.Port + 1})
+		if err == nil {
+			break
+		}
+		control.Close()
+		if base.Port != 0 {
+			return nil, fmt.Errorf("data port %d: %v", local.Port+1, err)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &Session{
+		Name:    name,
+		ssrc:    rand.Uint32(),
+		start:   time.Now(),
+		control: control,
+		data:    data,
+		peers:   make(map[uint32]*Peer),
+		pending: make(map[uint32]chan packet),
+	}, nil
+}
+
+// Addr returns the control port address; the data port is one above it.
+func (s *Session) Addr() *net.UDPAddr {
+	return s.control.LocalAddr().(*net.UDPAddr)
+}
+
+// Peers returns a copy of the connected peers.
+func (s *Session) Peers() []Peer {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	peers := make([]Peer, 0, len(s.peers))
+	for _, p := range s.peers {
+		peers = append(peers, *p)
+	}
+	return peers
+}
+
+// Serve handles incoming packets and keeps clock sync running with peers we
+// invited, until ctx is done. Invite requires Serve to be running.
+func (s *Session) Serve(ctx context.Context) error {
+	errs := make(chan error, 2)
+	go func() { errs <- s.readLoop(s.control, false) }()
+	go func() { errs <- s.readLoop(s.data, true) }()
+
+	ticker := time.NewTicker(syncInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			s.Close()
+			return nil
+		case err := <-errs:
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
+		case <-ticker.C:
+			for _, p := range s.Peers() {
+				if p.initiated {
+					s.sync(p.Data, 0, [3]uint64{s.now()})
+				}
+			}
+		}
+	}
+}
+
+// Invite joins the session listening at addr (its control port) and
+// returns once both ports have accepted.
+func (s *Session) Invite(ctx context.Context, addr string) (Peer, error) {
+	control, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return Peer{}, err
+	}
+	data := &net.UDPAddr{IP: control.IP, Port: control.Port + 1, Zone: control.Zone}
+
+	token := rand.Uint32()
+	replies := make(chan packet, 4)
+	s.mu.Lock()
+	s.pending[token] = replies
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		delete(s.pending, token)
+		s.mu.Unlock()
+	}()
+
+	var reply packet
+	for _, port := range []struct {
+		conn   *net.UDPConn
+		to     *net.UDPAddr
+		isData bool
+	}{{s.control, control, false}, {s.data, data, true}} {
+		reply, err = s.invite(ctx, port.conn, port.to, port.isData, token, replies)
+		if err != nil {
+			return Peer{}, err
+		}
+	}
+
+	peer := &Peer{Name: reply.name, SSRC: reply.ssrc, Control: control, Data: data, initiated: true}
+	s.mu.Lock()
+	s.peers[peer.SSRC] = peer
+	s.mu.Unlock()
+	s.sync(data, 0, [3]uint64{s.now()})
+	return *peer, nil
+}
+
+func (s *Session) invite(ctx context.Context, conn *net.UDPConn, to *net.UDPAddr, isData bool, token uint32, replies chan packet) (packet, error) {
+	for try := 0; try < inviteRetries; try++ {
+		if _, err := conn.WriteToUDP(s.exchange(cmdInvitation, token), to); err != nil {
+			return packet{}, err
+		}
+		timeout := time.After(inviteTimeout)
+	wait:
+		for {
+			select {
+			case p := <-replies:
+				if p.onData != isData {
+					continue // a late answer to a retried invitation
+				}
+				if p.command == cmdReject {
+					return packet{}, fmt.Errorf("%s rejected the invitation", to)
+				}
+				return p, nil
+			case <-timeout:
+				break wait
+			case <-ctx.Done():
+				return packet{}, ctx.Err()
+			}
+		}
+	}
+	return packet{}, fmt.Errorf("no answer from %s", to)
+}
+
+// Send writes one or more complete MIDI messages to every peer.
+func (s *Session) Send(msgs ...[]byte) error {
+	s.mu.Lock()
+	s.seq++
+	seq := s.seq
+	targets := make([]*net.UDPAddr, 0, len(s.peers))
+	for _, p := range s.peers {
+		targets = append(targets, p.Data)
+	}
+	s.mu.Unlock()
+
+	if len(targets) == 0 {
+		return nil
+	}
+	b, err := encodeRTP(seq, uint32(s.now()), s.ssrc, msgs)
+	if err != nil {
+		return err
+	}
+	// One unreachable peer mustn't cost the others their notes.
+	var errs []error
+	for _, to := range targets {
+		if _, err := s.data.WriteToUDP(b, to); err != nil {
+			errs = append(errs, fmt.Errorf("send to %s: %v", to, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Close says goodbye to every peer and releases the ports.
+func (s *Session) Close() error {
+	s.mu.Lock()
+	peers := s.peers
+	s.peers = make(map[uint32]*Peer)
+	s.mu.Unlock()
+	for _, p := range peers {
+		s.control.WriteToUDP(s.exchange(cmdBye, 0), p.Control)
+	}
+	s.data.Close()
+	return s.control.Close()
+}
+
+// now is the session time in RTP-MIDI's 100µs units.
+func (s *Session) now() uint64 {
+	return uint64(time.Since(s.start) / (100 * time.Microsecond))
+}
+
+// --------------------
+// Session protocol
+// --------------------
+
+type packet struct {
+	command string
+	token   uint32
+	ssrc    uint32
+	name    string
+	onData  bool // arrived on the data port
+
+	// clock sync
+	count      uint8
+	timestamps [3]uint64
+}
+
+func (s *Session) exchange(command string, token uint32) []byte {
+	var b bytes.Buffer
+	b.Write(signature)
+	b.WriteString(command)
+	binary.Write(&b, binary.BigEndian, uint32(protocolVersion))
+	binary.Write(&b, binary.BigEndian, token)
+	binary.Write(&b, binary.BigEndian, s.ssrc)
+	if command != cmdBye {
+		b.WriteString(s.Name)
+		b.WriteByte(0)
+	}
+	return b.Bytes()
+}
+
+func (s *Session) sync(to *net.UDPAddr, count uint8, ts [3]uint64) {
+	var b bytes.Buffer
+	b.Write(signature)
+	b.WriteString(cmdSync)
+	binary.Write(&b, binary.BigEndian, s.ssrc)
+	b.Write([]byte{count, 0, 0, 0})
+	for _, t := range ts {
+		binary.Write(&b, binary.BigEndian, t)
+	}
+	s.data.WriteToUDP(b.Bytes(), to)
+}
+
+func parseSessionPacket(b []byte) (packet, error) {
+	if len(b) < 4 || !bytes.Equal(b[:2], signature) {
+		return packet{}, errors.New("rtpmidi: not a session packet")
+	}
+	p := packet{command: string(b[2:4])}
+	switch p.command {
+	case cmdInvitation, cmdAccept, cmdReject, cmdBye:
+		if len(b) < 16 {
+			return packet{}, errors.New("rtpmidi: short session packet")
+		}
+		p.token = binary.BigEndian.Uint32(b[8:12])
+		p.ssrc = binary.BigEndian.Uint32(b[12:16])
+		if name := b[16:]; len(name) > 0 {
+			if end := bytes.IndexByte(name, 0); end >= 0 {
+				name = name[:end]
+			}
+			p.name = string(name)
+		}
+	case cmdSync:
+		if len(b) < 36 {
+			return packet{}, errors.New("rtpmidi: short sync packet")
+		}
+		p.ssrc = binary.BigEndian.Uint32(b[4:8])
+		p.count = b[8]
+		for i := range p.timestamps {
+			p.timestamps[i] = binary.BigEndian.Uint64(b[12+8*i:])
+		}
+	case cmdFeedback:
+	default:
+		return packet{}, fmt.Errorf("rtpmidi: unknown command %q", p.command)
+	}
+	return p, nil
+}
+
+func (s *Session) readLoop(conn *net.UDPConn, isData bool) error {
+	buf := make([]byte, 65536)
+	for {
+		n, from, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			return err
+		}
+		b := buf[:n]
+		if bytes.HasPrefix(b, signature) {
+			if p, err := parseSessionPacket(b); err == nil {
+				s.handleSession(conn, from, p, isData)
+			}
+			continue
+		}
+		if isData {
+			s.handleData(b)
+		}
+	}
+}
+
+func (s *Session) handleSession(conn *net.UDPConn, from *net.UDPAddr, p packet, isData bool) {
+	switch p.command {
+	case cmdInvitation:
+		// Accept everyone; the peer is registered once the data port joins.
+		conn.WriteToUDP(s.exchange(cmdAccept, p.token), from)
+		if isData {
+			s.mu.Lock()
+			s.peers[p.ssrc] = &Peer{
+				Name:    p.name,
+				SSRC:    p.ssrc,
+				Control: &net.UDPAddr{IP: from.IP, Port: from.Port - 1, Zone: from.Zone},
+				Data:    from,
+			}
+			s.mu.Unlock()
+		}
+
+	case cmdAccept, cmdReject:
+		p.onData = isData
+		s.mu.Lock()
+		replies := s.pending[p.token]
+		s.mu.Unlock()
+		if replies != nil {
+			select {
+			case replies <- p:
+			default:
+			}
+		}
+
+	case cmdBye:
+		s.mu.Lock()
+		delete(s.peers, p.ssrc)
+		s.mu.Unlock()
+
+	case cmdSync:
+		now := s.now()
+		switch p.count {
+		case 0:
+			s.sync(from, 1, [3]uint64{p.timestamps[0], now})
+		case 1:
+			s.sync(from, 2, [3]uint64{p.timestamps[0], p.timestamps[1], now})
+			s.setLatency(p.ssrc, (now-p.timestamps[0])/2)
+		case 2:
+			s.setLatency(p.ssrc, (now-p.timestamps[1])/2)
+		}
+	}
+}
+
+func (s *Session) setLatency(ssrc uint32, units uint64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if p, ok := s.peers[ssrc]; ok {
+		p.Latency = time.Duration(units) * 100 * time.Microsecond
+	}
+}
+
+func (s *Session) handleData(b []byte) {
+	ssrc, msgs, err := decodeRTP(b)
+	if err != nil || s.OnMIDI == nil {
+		return
+	}
+	s.mu.Lock()
+	peer, ok := s.peers[ssrc]
+	var from Peer
+	if ok {
+		from = *peer
+	}
+	s.mu.Unlock()
+	if !ok {
+		return // not in the session
+	}
+	for _, m := range msgs {
+		s.OnMIDI(m, from)
+	}
+}
+
+// --------------------
+// RTP MIDI payload
+// --------------------
+
+// encodeRTP builds an RTP packet carrying msgs with zero delta times and no
+// recovery journal.
+func encodeRTP(seq uint16, timestamp, ssrc uint32, msgs [][]byte) ([]byte, error) {
+	var list bytes.Buffer
+	for i, m := range msgs {
+		if len(m) == 0 {
+			return nil, errors.New("rtpmidi: empty MIDI message")
+		}
+		if i > 0 {
+			list.WriteByte(0) // delta time
+		}
+		list.Write(m)
+	}
+	if list.Len() > 0x0FFF {
+		return nil, errors.New("rtpmidi: MIDI list too long")
+	}
+
+	var b bytes.Buffer
+	b.Write([]byte{0x80, payloadType})
+	binary.Write(&b, binary.BigEndian, seq)
+	binary.Write(&b, binary.BigEndian, timestamp)
+	binary.Write(&b, binary.BigEndian, ssrc)
+	if list.Len() <= 0x0F {
+		b.WriteByte(byte(list.Len()))
+	} else {
+		binary.Write(&b, binary.BigEndian, uint16(0x8000|list.Len())) // B flag: long header
+	}
+	b.Write(list.Bytes())
+	return b.Bytes(), nil
+}
+
+// decodeRTP returns the sender and the MIDI messages in an RTP MIDI packet.
+func decodeRTP(b []byte) (ssrc uint32, msgs [][]byte, err error) {
+	if len(b) < 13 || b[0]>>6 != 2 || b[1]&0x7F != payloadType {
+		return 0, nil, errors.New("rtpmidi: not an RTP MIDI packet")
+	}
+	ssrc = binary.BigEndian.Uint32(b[8:12])
+	header := b[12]
+	rest := b[13:]
+	length := int(header & 0x0F)
+	if header&0x80 != 0 {
+		if len(rest) < 1 {
+			return 0, nil, errors.New("rtpmidi: truncated header")
+		}
+		length = length<<8 | int(rest[0])
+		rest = rest[1:]
+	}
+	if length > len(rest) {
+		return 0, nil, errors.New("rtpmidi: MIDI list overruns packet")
+	}
+	msgs, err = parseList(rest[:length], header&0x20 != 0)
+	return ssrc, msgs, err
+}
+
+// parseList splits a MIDI list into messages. firstDelta reports whether
+// the first command is preceded by a delta time (the Z flag).
+func parseList(list []byte, firstDelta bool) ([][]byte, error) {
+	var msgs [][]byte
+	var running byte
+	for i := 0; len(list) > 0; i++ {
+		if i > 0 || firstDelta {
+			// Delta times are 1-4 bytes with the high bit marking continuation.
+			n := 0
+			for n < 4 && n < len(list) && list[n]&0x80 != 0 {
+				n++
+			}
+			if n >= len(list) {
+				return msgs, nil // a trailing delta with no command
+			}
+			list = list[n+1:]
+			if len(list) == 0 {
+				return msgs, nil
+			}
+		}
+
+		status := list[0]
+		var data []byte
+		if status&0x80 != 0 {
+			list = list[1:]
+			if status < 0xF0 {
+				running = status
+			} else if status < 0xF8 {
+				running = 0
+			}
+		} else {
+			if running == 0 {
+				return msgs, errors.New("rtpmidi: data byte without running status")
+			}
+			status = running
+		}
+
+		size := dataLength(status)
+		if status == 0xF0 {
+			end := bytes.IndexByte(list, 0xF7)
+			if end < 0 {
+				return msgs, errors.New("rtpmidi: unterminated sysex")
+			}
+			size = end + 1
+		}
+		if size > len(list) {
+			return msgs, errors.New("rtpmidi: truncated MIDI command")
+		}
+		data, list = list[:size], list[size:]
+		msgs = append(msgs, append([]byte{status}, data...))
+	}
+	return msgs, nil
+}
+
+// dataLength is the number of data bytes following a status byte.
+func dataLength(status byte) int {
+	switch {
+	case status >= 0xF8:
+		return 0
+	case status < 0xF0:
+		switch status & 0xF0 {
+		case 0xC0, 0xD0:
+			return 1
+		}
+		return 2
+	}
+	switch status {
+	case 0xF1, 0xF3:
+		return 1
+	case 0xF2:
+		return 2
+	}
+	return 0
+}
@@ -0,0 +1,146 @@
+package rtpmidi
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestEncodeDecode(t *testing.T) {
+	msgs := [][]byte{{0x90, 60, 100}, {0xF8}, {0xB1, 7, 90}}
+	b, err := encodeRTP(7, 1234, 0xCAFE, msgs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ssrc, got, err := decodeRTP(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ssrc != 0xCAFE || len(got) != len(msgs) {
+		t.Fatalf("decoded ssrc %x, %d messages", ssrc, len(got))
+	}
+	for i := range msgs {
+		if !bytes.Equal(got[i], msgs[i]) {
+			t.Errorf("message %d = % x, want % x", i, got[i], msgs[i])
+		}
+	}
+}
+
+func TestParseListRunningStatusAndDeltas(t *testing.T) {
+	// Z flag set: a two-byte delta precedes the first command; the second
+	// note uses running status.
+	list := []byte{0x81, 0x00, 0x90, 60, 100, 0x05, 62, 0, 0x00, 0xC2, 5}
+	got, err := parseList(list, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := [][]byte{{0x90, 60, 100}, {0x90, 62, 0}, {0xC2, 5}}
+	if len(got) != len(want) {
+		t.Fatalf("got %d messages, want %d", len(got), len(want))
+	}
+	for i := range want {
+		if !bytes.Equal(got[i], want[i]) {
+			t.Errorf("message %d = % x, want % x", i, got[i], want[i])
+		}
+	}
+}
+
+// TestTwoSessions runs an initiator and a responder on localhost and
+// exchanges MIDI both ways.
+func TestTwoSessions(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	responder, err := Listen("synth", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	initiator, err := Listen("hub", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	atResponder := make(chan []byte, 4)
+	atInitiator := make(chan []byte, 4)
+	responder.OnMIDI = func(m []byte, _ Peer) { atResponder <- m }
+	initiator.OnMIDI = func(m []byte, _ Peer) { atInitiator <- m }
+	go responder.Serve(ctx)
+	go initiator.Serve(ctx)
+
+	peer, err := initiator.Invite(ctx, responder.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if peer.Name != "synth" {
+		t.Errorf("peer name = %q, want synth", peer.Name)
+	}
+
+	receive := func(ch chan []byte, want []byte) {
+		t.Helper()
+		select {
+		case got := <-ch:
+			if !bytes.Equal(got, want) {
+				t.Errorf("received % x, want % x", got, want)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("timed out waiting for MIDI")
+		}
+	}
+
+	noteOn := []byte{0x90, 64, 110}
+	if err := initiator.Send(noteOn); err != nil {
+		t.Fatal(err)
+	}
+	receive(atResponder, noteOn)
+
+	// The responder registers the initiator when its data port is invited.
+	if peers := responder.Peers(); len(peers) != 1 || peers[0].Name != "hub" {
+		t.Fatalf("responder peers = %+v", peers)
+	}
+	noteOff := []byte{0x80, 64, 0}
+	if err := responder.Send(noteOff); err != nil {
+		t.Fatal(err)
+	}
+	receive(atInitiator, noteOff)
+
+	initiator.Close()
+	deadline := time.Now().Add(time.Second)
+	for len(responder.Peers()) > 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("responder did not drop the peer after bye")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestSendReachesPeersAfterAFailure(t *testing.T) {
+	s, err := Listen("hub", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	good, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer good.Close()
+
+	// Port 0 can't be sent to. Peers are kept in a map, so with several
+	// broken ones the good peer is rarely first.
+	for i := uint32(1); i <= 4; i++ {
+		s.peers[i] = &Peer{Data: &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 0}}
+	}
+	s.peers[5] = &Peer{Data: good.LocalAddr().(*net.UDPAddr)}
+
+	buf := make([]byte, 64)
+	for i := 0; i < 5; i++ {
+		if err := s.Send([]byte{0x90, 60, 100}); err == nil {
+			t.Fatal("Send hid the failed writes")
+		}
+		good.SetReadDeadline(time.Now().Add(time.Second))
+		if _, _, err := good.ReadFromUDP(buf); err != nil {
+			t.Fatalf("send %d: good peer got nothing: %v", i, err)
+		}
+	}
+}
@@ -0,0 +1,139 @@
+// Package scale constrains notes to a key and scale, so that whatever an
+// untrained audience presses sounds consonant.
+package scale
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+var scaleIntervals = map[string][]int{
+	"chromatic":        {0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11},
+	"major":            {0, 2, 4, 5, 7, 9, 11},
+	"minor":            {0, 2, 3, 5, 7, 8, 10},
+	"harmonic-minor":   {0, 2, 3, 5, 7, 8, 11},
+	"dorian":           {0, 2, 3, 5, 7, 9, 10},
+	"phrygian":         {0, 1, 3, 5, 7, 8, 10},
+	"lydian":           {0, 2, 4, 6, 7, 9, 11},
+	"mixolydian":       {0, 2, 4, 5, 7, 9, 10},
+	"locrian":          {0, 1, 3, 5, 6, 8, 10},
+	"major-pentatonic": {0, 2, 4, 7, 9},
+	"minor-pentatonic": {0, 3, 5, 7, 10},
+	"blues":            {0, 3, 5, 6, 7, 10},
+}
+
+var pitchClasses = map[string]int{
+	"C": 0, "B#": 0,
+	"C#": 1, "DB": 1,
+	"D":  2,
+	"D#": 3, "EB": 3,
+	"E": 4, "FB": 4,
+	"F": 5, "E#": 5,
+	"F#": 6, "GB": 6,
+	"G":  7,
+	"G#": 8, "AB": 8,
+	"A":  9,
+	"A#": 10, "BB": 10,
+	"B": 11, "CB": 11,
+}
+
+// Names returns the supported scale names in alphabetical order.
+func Names() []string {
+	names := make([]string, 0, len(scaleIntervals))
+	for name := range scaleIntervals {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+type Scale struct {
+	Root      int   // pitch class of the key, 0 = C
+	Intervals []int // semitones above the root, ascending
+}
+
+// Parse builds a scale from a key name ("C", "F#", "Bb") and a scale name
+// ("major", "minor-pentatonic", ...).
+func Parse(key, name string) (*Scale, error) {
+	root, ok := pitchClasses[strings.ToUpper(strings.TrimSpace(key))]
+	if !ok {
+		return nil, fmt.Errorf("unknown key %q", key)
+	}
+	intervals, ok := scaleIntervals[strings.ToLower(strings.TrimSpace(name))]
+	if !ok {
+		return nil, fmt.Errorf("unknown scale %q (want one of %s)", name, strings.Join(Names(), ", "))
+	}
+	return &Scale{Root: root, Intervals: intervals}, nil
+}
+
+func (s *Scale) Contains(note uint8) bool {
+	pc := (int(note) - s.Root + 12) % 12
+	for _, i := range s.Intervals {
+		if i == pc {
+			return true
+		}
+	}
+	return false
+}
+
+// Snap returns the in-scale note nearest to note. Ties resolve downwards.
+func (s *Scale) Snap(note uint8) uint8 {
+	for offset := 0; offset < 12; offset++ {
+		if down := int(note) - offset; down >= 0 && s.Contains(uint8(down)) {
+			return uint8(down)
+		}
+		if up := int(note) + offset; up <= 127 && s.Contains(uint8(up)) {
+			return uint8(up)
+		}
+	}
+	return note
+}
+
+// Degree returns the index-th note of the scale counting up from the first
+// root at or above base, continuing into higher octaves.
+func (s *Scale) Degree(index int, base uint8) uint8 {
+	if index < 0 {
+		index = 0
+	}
+	root := int(base) + (s.Root-int(base)%12+12)%12
+	note := root + 12*(index/len(s.Intervals)) + s.Intervals[index%len(s.Intervals)]
+	if note > 127 {
+		note = 127
+	}
+	if note < 0 {
+		note = 0
+	}
+	return uint8(note)
+}
+
+// Step snaps note into the scale and then moves it steps scale degrees up
+// (or down, for negative steps). Step(note, 2) is a diatonic third.
+func (s *Scale) Step(note uint8, steps int) uint8 {
+	snapped := int(s.Snap(note))
+	pc := (snapped - s.Root + 12) % 12
+	index := 0
+	for i, interval := range s.Intervals {
+		if interval == pc {
+			index = i
+			break
+		}
+	}
+
+	n := len(s.Intervals)
+	target := index + steps
+	octaves := target / n
+	if target < 0 && target%n != 0 {
+		octaves--
+	}
+	degree := target - octaves*n
+
+	result := snapped - s.Intervals[index] + 12*octaves + s.Intervals[degree]
+	if result > 127 {
+		result = 127
+	}
+	if result < 0 {
+		result = 0
+	}
+	return uint8(result)
+}
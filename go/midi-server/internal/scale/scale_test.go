@@ -0,0 +1,76 @@
+package scale
+
+import "testing"
+
+func TestParse(t *testing.T) {
+	s, err := Parse("Bb", "Minor")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Root != 10 || len(s.Intervals) != 7 {
+		t.Errorf("unexpected scale: %+v", s)
+	}
+	if _, err := Parse("H", "major"); err == nil {
+		t.Error("expected error for unknown key")
+	}
+	if _, err := Parse("C", "klingon"); err == nil {
+		t.Error("expected error for unknown scale")
+	}
+}
+
+func TestSnap(t *testing.T) {
+	cMajor, _ := Parse("C", "major")
+	cases := map[uint8]uint8{
+		60: 60, // C stays
+		61: 60, // C# ties between C and D, resolves down
+		66: 65, // F# -> F
+		70: 69, // A# -> A
+	}
+	for in, want := range cases {
+		if got := cMajor.Snap(in); got != want {
+			t.Errorf("Snap(%d) = %d, want %d", in, got, want)
+		}
+	}
+
+	aMinorPent, _ := Parse("A", "minor-pentatonic")
+	for note := uint8(0); note < 128; note++ {
+		if !aMinorPent.Contains(aMinorPent.Snap(note)) {
+			t.Fatalf("Snap(%d) = %d is not in scale", note, aMinorPent.Snap(note))
+		}
+	}
+}
+
+func TestDegree(t *testing.T) {
+	dDorian, _ := Parse("D", "dorian")
+	// Base 60 (C4): the first D at or above is 62 (D4).
+	want := []uint8{62, 64, 65, 67, 69, 71, 72, 74}
+	for i, w := range want {
+		if got := dDorian.Degree(i, 60); got != w {
+			t.Errorf("Degree(%d) = %d, want %d", i, got, w)
+		}
+	}
+	if got := dDorian.Degree(100, 120); got != 127 {
+		t.Errorf("Degree past the top should clamp, got %d", got)
+	}
+}
+
+func TestStep(t *testing.T) {
+	cMajor, _ := Parse("C", "major")
+	cases := []struct {
+		note  uint8
+		steps int
+		want  uint8
+	}{
+		{60, 2, 64},  // C -> E
+		{64, 2, 67},  // E -> G
+		{71, 2, 74},  // B -> D above
+		{60, 7, 72},  // octave
+		{60, -1, 59}, // C -> B below
+		{61, 0, 60},  // out-of-scale notes snap first
+	}
+	for _, c := range cases {
+		if got := cMajor.Step(c.note, c.steps); got != c.want {
+			t.Errorf("Step(%d, %d) = %d, want %d", c.note, c.steps, got, c.want)
+		}
+	}
+}
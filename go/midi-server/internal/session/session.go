@@ -0,0 +1,157 @@
+// Package session gives each WebSocket client a stable identity that survives
+// reconnects, so a phone that drops off the venue Wi-Fi comes back as the
+// same client with its previous state.
+package session
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"sync"
+	"time"
+)
+
+// Session is the state kept for a client between connections. ID is public
+// and included in broadcasts; Token is the secret the client presents to
+// resume the session.
+type Session struct {
+	ID    string
+	Token string
+
+	mu       sync.Mutex
+	nickname string
+	group    string
+	presses  []time.Time
+	conns    int
+	lastSeen time.Time
+}
+
+func (s *Session) Nickname() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.nickname
+}
+
+func (s *Session) SetNickname(nickname string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.nickname = nickname
+}
+
+// Group returns the name of the audience group the client was assigned to,
+// or "" if it has none.
+func (s *Session) Group() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.group
+}
+
+func (s *Session) SetGroup(name string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.group = name
+}
+
+// Allow records a note press at now and reports whether it is within limit
+// presses per window. A limit of 0 disables rate limiting.
+func (s *Session) Allow(now time.Time, limit int, window time.Duration) bool {
+	if limit <= 0 {
+		return true
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	cutoff := now.Add(-window)
+	kept := s.presses[:0]
+	for _, t := range s.presses {
+		if t.After(cutoff) {
+			kept = append(kept, t)
+		}
+	}
+	s.presses = kept
+
+	if len(s.presses) >= limit {
+		return false
+	}
+	s.presses = append(s.presses, now)
+	return true
+}
+
+// Store holds sessions by token. Sessions with no open connection are kept
+// for the TTL so that a reconnecting client gets its state back.
+type Store struct {
+	mu       sync.Mutex
+	sessions map[string]*Session
+	ttl      time.Duration
+	now      func() time.Time
+}
+
+func NewStore(ttl time.Duration) *Store {
+	return &Store{
+		sessions: make(map[string]*Session),
+		ttl:      ttl,
+		now:      time.Now,
+	}
+}
+
+// Resume returns the session for token, or a new session if the token is
+// unknown or has expired. The boolean reports whether an existing session
+// was resumed.
+func (st *Store) Resume(token string) (*Session, bool) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	if s, ok := st.sessions[token]; ok && token != "" {
+		s.mu.Lock()
+		s.conns++
+		s.mu.Unlock()
+		return s, true
+	}
+
+	s := &Session{ID: randomHex(8), Token: randomHex(16), conns: 1}
+	st.sessions[s.Token] = s
+	return s, false
+}
+
+// Release marks one connection of s as closed.
+func (st *Store) Release(s *Session) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.conns > 0 {
+		s.conns--
+	}
+	s.lastSeen = st.now()
+}
+
+// Expire drops sessions that have had no connection for longer than the
+// TTL and returns how many were removed.
+func (st *Store) Expire() int {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	now := st.now()
+	removed := 0
+	for token, s := range st.sessions {
+		s.mu.Lock()
+		stale := s.conns == 0 && now.Sub(s.lastSeen) > st.ttl
+		s.mu.Unlock()
+		if stale {
+			delete(st.sessions, token)
+			removed++
+		}
+	}
+	return removed
+}
+
+func (st *Store) Len() int {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	return len(st.sessions)
+}
+
+func randomHex(n int) string {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
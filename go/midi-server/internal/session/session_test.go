@@ -0,0 +1,69 @@
+package session
+
+import (
+	"testing"
+	"time"
+)
+
+func TestResumeReturnsSameSession(t *testing.T) {
+	st := NewStore(time.Minute)
+	s, resumed := st.Resume("")
+	if resumed {
+		t.Fatal("new client should not be resumed")
+	}
+	s.SetNickname("drummer")
+	s.SetGroup("bass")
+	st.Release(s)
+
+	again, resumed := st.Resume(s.Token)
+	if !resumed || again.ID != s.ID || again.Nickname() != "drummer" || again.Group() != "bass" {
+		t.Errorf("expected to resume %s, got %s (resumed=%v)", s.ID, again.ID, resumed)
+	}
+
+	other, resumed := st.Resume("not-a-token")
+	if resumed || other.ID == s.ID {
+		t.Error("unknown token should create a new session")
+	}
+}
+
+func TestExpireDropsIdleSessions(t *testing.T) {
+	st := NewStore(time.Minute)
+	now := time.Now()
+	st.now = func() time.Time { return now }
+
+	idle, _ := st.Resume("")
+	active, _ := st.Resume("")
+	st.Release(idle)
+
+	now = now.Add(2 * time.Minute)
+	if removed := st.Expire(); removed != 1 {
+		t.Errorf("expected 1 session removed, got %d", removed)
+	}
+	if _, resumed := st.Resume(active.Token); !resumed {
+		t.Error("connected session should not expire")
+	}
+	if _, resumed := st.Resume(idle.Token); resumed {
+		t.Error("expired session should not resume")
+	}
+}
+
+func TestAllowSurvivesReconnect(t *testing.T) {
+	st := NewStore(time.Minute)
+	s, _ := st.Resume("")
+	now := time.Now()
+
+	for i := 0; i < 3; i++ {
+		if !s.Allow(now, 3, time.Second) {
+			t.Fatalf("press %d should be allowed", i)
+		}
+	}
+	st.Release(s)
+
+	s, _ = st.Resume(s.Token)
+	if s.Allow(now.Add(100*time.Millisecond), 3, time.Second) {
+		t.Error("rate limit history should carry over a reconnect")
+	}
+	if !s.Allow(now.Add(2*time.Second), 3, time.Second) {
+		t.Error("press after the window should be allowed")
+	}
+}
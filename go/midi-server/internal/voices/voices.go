@@ -0,0 +1,175 @@
+// Package voices caps how many notes sound on the MIDI output at once and
+// decides which note to steal when the cap is reached, so hundreds of
+// clients can't flood the synth.
+package voices
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+type Policy string
+
+const (
+	// StealNone drops the new note when the limit is reached.
+	StealNone     Policy = "none"
+	StealOldest   Policy = "oldest"
+	StealQuietest Policy = "quietest"
+	StealLowest   Policy = "lowest"
+)
+
+func ParsePolicy(s string) (Policy, error) {
+	switch p := Policy(s); p {
+	case StealNone, StealOldest, StealQuietest, StealLowest:
+		return p, nil
+	}
+	return "", fmt.Errorf("unknown steal policy %q", s)
+}
+
+type Voice struct {
+	ID       uint64
+	Channel  uint8
+	Note     uint8
+	Velocity uint8
+	Started  time.Time
+}
+
+type Stats struct {
+	Active     int    `json:"active"`
+	Played     uint64 `json:"played"`
+	Stolen     uint64 `json:"stolen"`
+	Dropped    uint64 `json:"dropped"`
+	Duplicates uint64 `json:"duplicates"`
+}
+
+// Allocator tracks sounding voices. A limit of 0 means unlimited.
+type Allocator struct {
+	mu         sync.Mutex
+	max        int
+	perChannel int
+	policy     Policy
+	active     []Voice
+	nextID     uint64
+	stats      Stats
+}
+
+func New(max, perChannel int, policy Policy) *Allocator {
+	return &Allocator{max: max, perChannel: perChannel, policy: policy}
+}
+
+// Acquire starts a voice for note on channel. It returns ok=false if the
+// note is already sounding or the limit was hit with nothing to steal; if
+// another voice had to make room it is returned as stolen and the caller
+// must silence it.
+func (a *Allocator) Acquire(channel, note, velocity uint8, now time.Time) (v Voice, stolen *Voice, ok bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	onChannel := 0
+	for _, existing := range a.active {
+		if existing.Channel == channel {
+			if existing.Note == note {
+				a.stats.Duplicates++
+				return Voice{}, nil, false
+			}
+			onChannel++
+		}
+	}
+
+	switch {
+	case a.perChannel > 0 && onChannel >= a.perChannel:
+		stolen, ok = a.steal(func(v Voice) bool { return v.Channel == channel })
+	case a.max > 0 && len(a.active) >= a.max:
+		stolen, ok = a.steal(func(Voice) bool { return true })
+	default:
+		ok = true
+	}
+	if !ok {
+		a.stats.Dropped++
+		return Voice{}, nil, false
+	}
+
+	a.nextID++
+	v = Voice{ID: a.nextID, Channel: channel, Note: note, Velocity: velocity, Started: now}
+	a.active = append(a.active, v)
+	a.stats.Played++
+	return v, stolen, true
+}
+
+// steal removes the voice chosen by the policy from those matching
+// candidate.
+func (a *Allocator) steal(candidate func(Voice) bool) (*Voice, bool) {
+	if a.policy == StealNone || a.policy == "" {
+		return nil, false
+	}
+	victim := -1
+	for i, v := range a.active {
+		if !candidate(v) {
+			continue
+		}
+		if victim < 0 || a.preferVictim(v, a.active[victim]) {
+			victim = i
+		}
+	}
+	if victim < 0 {
+		return nil, false
+	}
+	stolen := a.active[victim]
+	a.active = append(a.active[:victim], a.active[victim+1:]...)
+	a.stats.Stolen++
+	return &stolen, true
+}
+
+// preferVictim reports whether v is a better victim than current under the policy.
+// Ties go to the older voice.
+func (a *Allocator) preferVictim(v, current Voice) bool {
+	switch a.policy {
+	case StealQuietest:
+		if v.Velocity != current.Velocity {
+			return v.Velocity < current.Velocity
+		}
+	case StealLowest:
+		if v.Note != current.Note {
+			return v.Note < current.Note
+		}
+	}
+	return v.Started.Before(current.Started)
+}
+
+// Release ends the voice with id. It returns false if the voice is no longer
+// active (it was stolen or ended), in which case it has already been silenced.
+func (a *Allocator) Release(id uint64) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for i, v := range a.active {
+		if v.ID == id {
+			a.active = append(a.active[:i], a.active[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// End stops the voice sounding note on channel so the note can be played
+// again at once. It reports whether there was one; if so the caller must
+// silence it.
+func (a *Allocator) End(channel, note uint8) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for i, v := range a.active {
+		if v.Channel == channel && v.Note == note {
+			a.active = append(a.active[:i], a.active[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+func (a *Allocator) Stats() Stats {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	s := a.stats
+	s.Active = len(a.active)
+	return s
+}
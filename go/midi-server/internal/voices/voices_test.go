@@ -0,0 +1,102 @@
+package voices
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDuplicateNotesAreRejected(t *testing.T) {
+	a := New(0, 0, StealOldest)
+	now := time.Now()
+	if _, _, ok := a.Acquire(0, 60, 100, now); !ok {
+		t.Fatal("first note should play")
+	}
+	if _, _, ok := a.Acquire(0, 60, 100, now); ok {
+		t.Error("re-press of a sounding note should be rejected")
+	}
+	if _, _, ok := a.Acquire(1, 60, 100, now); !ok {
+		t.Error("same note on another channel should play")
+	}
+	if s := a.Stats(); s.Duplicates != 1 || s.Active != 2 {
+		t.Errorf("unexpected stats: %+v", s)
+	}
+}
+
+func TestStealPolicies(t *testing.T) {
+	start := time.Now()
+	cases := []struct {
+		policy Policy
+		want   uint8 // note expected to be stolen
+	}{
+		{StealOldest, 64},
+		{StealQuietest, 67},
+		{StealLowest, 60},
+	}
+	for _, c := range cases {
+		a := New(3, 0, c.policy)
+		a.Acquire(0, 64, 100, start)
+		a.Acquire(0, 60, 90, start.Add(time.Millisecond))
+		a.Acquire(0, 67, 30, start.Add(2*time.Millisecond))
+
+		_, stolen, ok := a.Acquire(0, 72, 100, start.Add(3*time.Millisecond))
+		if !ok || stolen == nil || stolen.Note != c.want {
+			t.Errorf("%s: stole %+v, want note %d", c.policy, stolen, c.want)
+		}
+		if s := a.Stats(); s.Active != 3 || s.Stolen != 1 {
+			t.Errorf("%s: unexpected stats %+v", c.policy, s)
+		}
+	}
+}
+
+func TestPerChannelLimitAndDrop(t *testing.T) {
+	a := New(0, 1, StealNone)
+	now := time.Now()
+	a.Acquire(2, 60, 100, now)
+	if _, _, ok := a.Acquire(2, 62, 100, now); ok {
+		t.Error("second note on a full channel should be dropped")
+	}
+	if _, _, ok := a.Acquire(3, 62, 100, now); !ok {
+		t.Error("other channels are not affected by the per-channel limit")
+	}
+	if s := a.Stats(); s.Dropped != 1 {
+		t.Errorf("expected 1 dropped, got %+v", s)
+	}
+}
+
+func TestReleaseAfterSteal(t *testing.T) {
+	a := New(1, 0, StealOldest)
+	now := time.Now()
+	first, _, _ := a.Acquire(0, 60, 100, now)
+	second, stolen, _ := a.Acquire(0, 62, 100, now.Add(time.Millisecond))
+
+	if stolen == nil || stolen.ID != first.ID {
+		t.Fatalf("expected first voice to be stolen, got %+v", stolen)
+	}
+	if a.Release(first.ID) {
+		t.Error("releasing a stolen voice should report false")
+	}
+	if !a.Release(second.ID) {
+		t.Error("releasing an active voice should report true")
+	}
+}
+
+func TestEndLetsANoteRetrigger(t *testing.T) {
+	a := New(0, 0, StealOldest)
+	now := time.Now()
+	first, _, _ := a.Acquire(0, 60, 100, now)
+	if !a.End(0, 60) {
+		t.Fatal("End found no sounding voice")
+	}
+	if a.End(0, 60) {
+		t.Error("End found a voice that had already ended")
+	}
+	if _, _, ok := a.Acquire(0, 60, 80, now); !ok {
+		t.Error("note should play again after End")
+	}
+	if a.Release(first.ID) {
+		t.Error("released a voice that End had already silenced")
+	}
+	if s := a.Stats(); s.Duplicates != 0 || s.Active != 1 {
+		t.Errorf("unexpected stats: %+v", s)
+	}
+}
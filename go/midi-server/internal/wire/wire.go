@@ -0,0 +1,165 @@
+// Package wire encodes WebSocket frames. JSON text frames are the default;
+// clients that ask for the compact subprotocol get note traffic as raw MIDI
+// bytes in binary frames, which costs far less to encode at hundreds of
+// clients. Everything else stays JSON in both protocols.
+//
+// Every JSON frame carries an envelope: the message type plus the protocol
+// version, a per-connection sequence number and a send timestamp. A batch
+// of messages is a JSON array of enveloped objects, or in the compact
+// protocol a binary frame of back-to-back note-ons.
+package wire
+
+import (
+	"encoding/json"
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Version is the protocol version this server speaks. MinVersion is the
+// oldest client version it still accepts.
+const (
+	Version    = 1
+	MinVersion = 1
+)
+
+// Header is the per-frame part of the envelope. Seq counts every message
+// sent to a connection, binary frames and dropped messages included, so
+// JSON clients can spot gaps.
+type Header struct {
+	Seq  uint64
+	Time time.Time
+}
+
+// Envelope documents the fields present on every JSON frame.
+type Envelope struct {
+	Type    string `json:"type"`
+	Version int    `json:"version"`
+	Seq     uint64 `json:"seq"`
+	Time    int64  `json:"ts"` // Unix milliseconds
+}
+
+// SubprotocolCompact is the Sec-WebSocket-Protocol value that selects the
+// compact codec.
+const SubprotocolCompact = "midi-lab.compact"
+
+// MIDIEncoder is implemented by messages that have a raw MIDI form. It
+// returns false if this particular message has none.
+type MIDIEncoder interface {
+	MIDIBytes() ([]byte, bool)
+}
+
+// Batcher is implemented by messages that bundle several others into one
+// frame. Every message in a batch shares its header.
+type Batcher interface {
+	Messages() []interface{}
+}
+
+// Codec turns outgoing messages into frames.
+type Codec interface {
+	// Encode returns the websocket message type and payload for msg.
+	Encode(msg interface{}, h Header) (messageType int, data []byte, err error)
+}
+
+type JSON struct{}
+
+// Encode marshals msg, which must be a JSON object with a "type", and adds
+// the envelope fields to it. A Batcher becomes an array of such objects.
+func (JSON) Encode(msg interface{}, h Header) (int, []byte, error) {
+	var b []byte
+	var err error
+	if batch, ok := msg.(Batcher); ok {
+		b = append(b, '[')
+		for i, m := range batch.Messages() {
+			if i > 0 {
+				b = append(b, ',')
+			}
+			if b, err = appendEnveloped(b, m, h); err != nil {
+				return 0, nil, err
+			}
+		}
+		b = append(b, ']')
+	} else if b, err = appendEnveloped(nil, msg, h); err != nil {
+		return 0, nil, err
+	}
+	return websocket.TextMessage, b, nil
+}
+
+func appendEnveloped(b []byte, msg interface{}, h Header) ([]byte, error) {
+	payload, err := json.Marshal(msg)
+	if err != nil {
+		return nil, err
+	}
+	if len(payload) < 2 || payload[0] != '{' {
+		return nil, errors.New("wire: message is not a JSON object")
+	}
+
+	if b == nil {
+		b = make([]byte, 0, len(payload)+48)
+	}
+	b = append(b, `{"version":`...)
+	b = strconv.AppendInt(b, Version, 10)
+	b = append(b, `,"seq":`...)
+	b = strconv.AppendUint(b, h.Seq, 10)
+	b = append(b, `,"ts":`...)
+	b = strconv.AppendInt(b, h.Time.UnixMilli(), 10)
+	if len(payload) > 2 {
+		b = append(b, ',')
+	}
+	return append(b, payload[1:]...), nil
+}
+
+// Compact sends MIDIEncoder messages as binary frames and everything else
+// as JSON. A batch is binary only if every message in it has a MIDI form.
+type Compact struct{}
+
+func (Compact) Encode(msg interface{}, h Header) (int, []byte, error) {
+	if batch, ok := msg.(Batcher); ok {
+		var b []byte
+		for _, m := range batch.Messages() {
+			midi, ok := midiBytes(m)
+			if !ok {
+				return JSON{}.Encode(msg, h)
+			}
+			b = append(b, midi...)
+		}
+		return websocket.BinaryMessage, b, nil
+	}
+	if b, ok := midiBytes(msg); ok {
+		return websocket.BinaryMessage, b, nil
+	}
+	return JSON{}.Encode(msg, h)
+}
+
+func midiBytes(msg interface{}) ([]byte, bool) {
+	if m, ok := msg.(MIDIEncoder); ok {
+		return m.MIDIBytes()
+	}
+	return nil, false
+}
+
+// ForSubprotocol returns the codec for a negotiated subprotocol; anything
+// unrecognised, including none, gets JSON.
+func ForSubprotocol(name string) Codec {
+	if name == SubprotocolCompact {
+		return Compact{}
+	}
+	return JSON{}
+}
+
+// Note is a note-on decoded from a compact client frame.
+type Note struct {
+	Channel  uint8
+	Note     uint8
+	Velocity uint8
+}
+
+// DecodeNote parses a binary client frame: a 3-byte MIDI note-on.
+func DecodeNote(b []byte) (Note, error) {
+	if len(b) != 3 || b[0]&0xF0 != 0x90 || b[1] > 127 || b[2] > 127 {
+		return Note{}, errors.New("wire: binary frame is not a MIDI note-on")
+	}
+	return Note{Channel: b[0] & 0x0F, Note: b[1], Velocity: b[2]}, nil
+}
@@ -0,0 +1,145 @@
+package wire
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// note mirrors the server's note broadcast closely enough to compare costs.
+type note struct {
+	Type     string `json:"type"`
+	Note     uint8  `json:"note"`
+	Velocity uint8  `json:"velocity"`
+	Channel  uint8  `json:"channel"`
+	From     string `json:"from,omitempty"`
+	Nickname string `json:"nickname,omitempty"`
+}
+
+func (n note) MIDIBytes() ([]byte, bool) {
+	return []byte{0x90 | n.Channel, n.Note, n.Velocity}, true
+}
+
+type cue struct {
+	Type string `json:"type"`
+	Text string `json:"text"`
+}
+
+var header = Header{Seq: 42, Time: time.UnixMilli(1_700_000_000_000)}
+
+var sample = note{Type: "note", Note: 64, Velocity: 100, Channel: 2, From: "c-1234abcd", Nickname: "row F"}
+
+func TestCompactEncodesNotesAsMIDI(t *testing.T) {
+	typ, b, err := Compact{}.Encode(sample, header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if typ != websocket.BinaryMessage || !bytes.Equal(b, []byte{0x92, 64, 100}) {
+		t.Errorf("got type %d % x", typ, b)
+	}
+
+	typ, b, err = Compact{}.Encode(cue{Type: "cue", Text: "Verse"}, header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if typ != websocket.TextMessage || string(b) != `{"version":1,"seq":42,"ts":1700000000000,"type":"cue","text":"Verse"}` {
+		t.Errorf("non-MIDI messages should stay JSON, got %d %s", typ, b)
+	}
+}
+
+func TestJSONEnvelope(t *testing.T) {
+	_, b, err := JSON{}.Encode(sample, header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var env Envelope
+	if err := json.Unmarshal(b, &env); err != nil {
+		t.Fatalf("%s: %v", b, err)
+	}
+	if env != (Envelope{Type: "note", Version: Version, Seq: 42, Time: 1_700_000_000_000}) {
+		t.Errorf("envelope = %+v", env)
+	}
+	var payload note
+	if err := json.Unmarshal(b, &payload); err != nil || payload != sample {
+		t.Errorf("payload = %+v, %v", payload, err)
+	}
+
+	if _, _, err := (JSON{}).Encode([]int{1}, header); err == nil {
+		t.Error("non-object messages should be rejected")
+	}
+}
+
+func TestForSubprotocol(t *testing.T) {
+	if _, ok := ForSubprotocol(SubprotocolCompact).(Compact); !ok {
+		t.Error("compact subprotocol should select the compact codec")
+	}
+	if _, ok := ForSubprotocol("").(JSON); !ok {
+		t.Error("no subprotocol should select JSON")
+	}
+}
+
+func TestDecodeNote(t *testing.T) {
+	n, err := DecodeNote([]byte{0x93, 60, 90})
+	if err != nil || n != (Note{Channel: 3, Note: 60, Velocity: 90}) {
+		t.Errorf("DecodeNote = %+v, %v", n, err)
+	}
+	for _, b := range [][]byte{{0x80, 60, 0}, {0x90, 60}, {0x90, 200, 1}} {
+		if _, err := DecodeNote(b); err == nil {
+			t.Errorf("expected error for % x", b)
+		}
+	}
+}
+
+func BenchmarkEncodeNoteJSON(b *testing.B) {
+	var bytesOut int
+	for i := 0; i < b.N; i++ {
+		_, data, _ := JSON{}.Encode(sample, header)
+		bytesOut += len(data)
+	}
+	b.ReportMetric(float64(bytesOut)/float64(b.N), "bytes/frame")
+}
+
+func BenchmarkEncodeNoteCompact(b *testing.B) {
+	var bytesOut int
+	for i := 0; i < b.N; i++ {
+		_, data, _ := Compact{}.Encode(sample, header)
+		bytesOut += len(data)
+	}
+	b.ReportMetric(float64(bytesOut)/float64(b.N), "bytes/frame")
+}
+
+type batch []interface{}
+
+func (b batch) Messages() []interface{} { return b }
+
+func TestBatchEncoding(t *testing.T) {
+	other := note{Type: "note", Note: 65, Velocity: 90, Channel: 2}
+	typ, b, err := Compact{}.Encode(batch{sample, other}, header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if typ != websocket.BinaryMessage || !bytes.Equal(b, []byte{0x92, 64, 100, 0x92, 65, 90}) {
+		t.Errorf("note batch: got type %d % x", typ, b)
+	}
+
+	// One non-MIDI message makes the whole batch JSON.
+	typ, b, err = Compact{}.Encode(batch{sample, cue{Type: "cue", Text: "Verse"}}, header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var envs []Envelope
+	if typ != websocket.TextMessage || json.Unmarshal(b, &envs) != nil || len(envs) != 2 {
+		t.Fatalf("mixed batch: got type %d %s", typ, b)
+	}
+	for _, env := range envs {
+		if env.Seq != header.Seq || env.Version != Version {
+			t.Errorf("batched envelope = %+v", env)
+		}
+	}
+	if envs[1].Type != "cue" {
+		t.Errorf("batch order lost: %s", b)
+	}
+}
@@ -0,0 +1,124 @@
+// Package wsconn keeps WebSocket connections honest: server pings with
+// pong-based liveness, read and write deadlines, a maximum message size and
+// close frames with meaningful codes. Phones that vanish without closing are
+// noticed within the pong timeout instead of lingering until idle timeout.
+package wsconn
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Close codes beyond those gorilla/websocket defines.
+const (
+	// CloseIdle is sent when a client has been connected but silent too long.
+	CloseIdle = 4000
+)
+
+type Config struct {
+	PingInterval   time.Duration // how often the server pings
+	PongTimeout    time.Duration // how long without a pong or message before the peer is dead
+	WriteTimeout   time.Duration // how long a single write may block
+	MaxMessageSize int64         // largest client frame accepted, in bytes
+}
+
+var Default = Config{
+	PingInterval:   20 * time.Second,
+	PongTimeout:    45 * time.Second,
+	WriteTimeout:   10 * time.Second,
+	MaxMessageSize: 4096,
+}
+
+func (c Config) Validate() error {
+	if c.PingInterval <= 0 || c.PongTimeout <= 0 || c.WriteTimeout <= 0 {
+		return fmt.Errorf("ping interval, pong timeout and write timeout must be positive")
+	}
+	if c.PingInterval >= c.PongTimeout {
+		return fmt.Errorf("ping interval %v must be shorter than pong timeout %v", c.PingInterval, c.PongTimeout)
+	}
+	if c.MaxMessageSize <= 0 {
+		return fmt.Errorf("max message size must be positive")
+	}
+	return nil
+}
+
+// Conn wraps a websocket.Conn. ReadMessage and WriteMessage apply the
+// deadlines; as with gorilla, there may be one concurrent reader and one
+// concurrent writer. CloseWith and Close are safe from any goroutine.
+type Conn struct {
+	*websocket.Conn
+	cfg  Config
+	done chan struct{}
+	once sync.Once
+}
+
+// New applies cfg to ws and starts pinging it.
+func New(ws *websocket.Conn, cfg Config) *Conn {
+	c := &Conn{Conn: ws, cfg: cfg, done: make(chan struct{})}
+	ws.SetReadLimit(cfg.MaxMessageSize)
+	ws.SetReadDeadline(time.Now().Add(cfg.PongTimeout))
+	ws.SetPongHandler(func(string) error {
+		return ws.SetReadDeadline(time.Now().Add(cfg.PongTimeout))
+	})
+	go c.ping()
+	return c
+}
+
+func (c *Conn) ping() {
+	ticker := time.NewTicker(c.cfg.PingInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.done:
+			return
+		case <-ticker.C:
+			deadline := time.Now().Add(c.cfg.WriteTimeout)
+			if err := c.Conn.WriteControl(websocket.PingMessage, nil, deadline); err != nil {
+				c.Close()
+				return
+			}
+		}
+	}
+}
+
+// ReadMessage reads the next frame. Any frame, like a pong, proves the peer
+// is alive and extends the read deadline.
+func (c *Conn) ReadMessage() (int, []byte, error) {
+	messageType, data, err := c.Conn.ReadMessage()
+	if err == nil {
+		c.Conn.SetReadDeadline(time.Now().Add(c.cfg.PongTimeout))
+	}
+	return messageType, data, err
+}
+
+// WriteMessage writes one frame, failing if the peer doesn't take it
+// within the write timeout.
+func (c *Conn) WriteMessage(messageType int, data []byte) error {
+	c.Conn.SetWriteDeadline(time.Now().Add(c.cfg.WriteTimeout))
+	return c.Conn.WriteMessage(messageType, data)
+}
+
+// CloseWith sends a close frame with code and reason, then closes the
+// connection. Only the first Close or CloseWith has any effect.
+func (c *Conn) CloseWith(code int, reason string) {
+	c.once.Do(func() {
+		deadline := time.Now().Add(c.cfg.WriteTimeout)
+		c.Conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, reason), deadline)
+		c.shutdown()
+	})
+}
+
+// Close closes the connection without a close frame, for when the peer is
+// already gone.
+func (c *Conn) Close() error {
+	c.once.Do(c.shutdown)
+	return nil
+}
+
+func (c *Conn) shutdown() {
+	close(c.done)
+	c.Conn.Close()
+}
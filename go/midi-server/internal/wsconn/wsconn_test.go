@@ -0,0 +1,150 @@
+package wsconn
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+var fast = Config{
+	PingInterval:   20 * time.Millisecond,
+	PongTimeout:    100 * time.Millisecond,
+	WriteTimeout:   100 * time.Millisecond,
+	MaxMessageSize: 64,
+}
+
+// serve starts a server that wraps each connection with cfg and hands it to
+// handle, and dials it with a stand-in client.
+func serve(t *testing.T, cfg Config, handle func(*Conn)) *websocket.Conn {
+	t.Helper()
+	upgrader := websocket.Upgrader{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ws, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		handle(New(ws, cfg))
+	}))
+	t.Cleanup(srv.Close)
+
+	client, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { client.Close() })
+	return client
+}
+
+// readResult runs the server's read loop and reports how it ended.
+func readResult(c *Conn, result chan error) {
+	for {
+		if _, _, err := c.ReadMessage(); err != nil {
+			result <- err
+			return
+		}
+	}
+}
+
+func TestPongsKeepClientAlive(t *testing.T) {
+	result := make(chan error, 1)
+	client := serve(t, fast, func(c *Conn) { readResult(c, result) })
+
+	// gorilla answers pings while the client is reading.
+	go func() {
+		for {
+			if _, _, err := client.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+
+	select {
+	case err := <-result:
+		t.Fatalf("live client was dropped: %v", err)
+	case <-time.After(5 * fast.PongTimeout):
+	}
+}
+
+func TestSilentClientTimesOut(t *testing.T) {
+	result := make(chan error, 1)
+	// The stand-in never reads, so it never answers pings.
+	serve(t, fast, func(c *Conn) { readResult(c, result) })
+
+	select {
+	case err := <-result:
+		var netErr interface{ Timeout() bool }
+		if !errors.As(err, &netErr) || !netErr.Timeout() {
+			t.Errorf("expected a read timeout, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("dead client was not detected")
+	}
+}
+
+func TestOversizedMessageClosesWith1009(t *testing.T) {
+	result := make(chan error, 1)
+	client := serve(t, fast, func(c *Conn) { readResult(c, result) })
+
+	client.WriteMessage(websocket.TextMessage, []byte(strings.Repeat("x", 100)))
+
+	client.SetReadDeadline(time.Now().Add(time.Second))
+	_, _, err := client.ReadMessage()
+	if !websocket.IsCloseError(err, websocket.CloseMessageTooBig) {
+		t.Errorf("client got %v, want close 1009", err)
+	}
+	if err := <-result; !errors.Is(err, websocket.ErrReadLimit) {
+		t.Errorf("server got %v, want read limit error", err)
+	}
+}
+
+func TestCloseWithSendsCode(t *testing.T) {
+	client := serve(t, fast, func(c *Conn) { c.CloseWith(websocket.CloseGoingAway, "server shutting down") })
+
+	client.SetReadDeadline(time.Now().Add(time.Second))
+	_, _, err := client.ReadMessage()
+	var closeErr *websocket.CloseError
+	if !errors.As(err, &closeErr) || closeErr.Code != websocket.CloseGoingAway || closeErr.Text != "server shutting down" {
+		t.Errorf("got %v, want close 1001 with reason", err)
+	}
+}
+
+func TestWriteTimeoutOnStalledClient(t *testing.T) {
+	result := make(chan error, 1)
+	// The stand-in never reads, so the socket buffers eventually fill.
+	serve(t, fast, func(c *Conn) {
+		frame := make([]byte, 256*1024)
+		for {
+			if err := c.WriteMessage(websocket.BinaryMessage, frame); err != nil {
+				result <- err
+				return
+			}
+		}
+	})
+
+	select {
+	case err := <-result:
+		var netErr interface{ Timeout() bool }
+		if !errors.As(err, &netErr) || !netErr.Timeout() {
+			t.Errorf("expected a write timeout, got %v", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("write to a stalled client never timed out")
+	}
+}
+
+func TestValidate(t *testing.T) {
+	if err := Default.Validate(); err != nil {
+		t.Errorf("default config: %v", err)
+	}
+	bad := Default
+	bad.PingInterval = bad.PongTimeout
+	if err := bad.Validate(); err == nil {
+		t.Error("ping interval equal to pong timeout should be rejected")
+	}
+}
@@ -3,13 +3,18 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
 	"log"
 	"net/http"
+	"net/url"
 	"os"
 	"os/signal"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -20,7 +25,22 @@ import (
 	"gitlab.com/gomidi/midi/writer"
 	"gitlab.com/gomidi/portmididrv"
 
+	"github.com/radcliffetech/midi-lab/go/midi-server/internal/backplane"
 	"github.com/radcliffetech/midi-lab/go/midi-server/internal/broadcast"
+	"github.com/radcliffetech/midi-lab/go/midi-server/internal/clock"
+	"github.com/radcliffetech/midi-lab/go/midi-server/internal/dynamics"
+	"github.com/radcliffetech/midi-lab/go/midi-server/internal/effects"
+	"github.com/radcliffetech/midi-lab/go/midi-server/internal/groups"
+	"github.com/radcliffetech/midi-lab/go/midi-server/internal/journal"
+	"github.com/radcliffetech/midi-lab/go/midi-server/internal/osc"
+	"github.com/radcliffetech/midi-lab/go/midi-server/internal/quantize"
+	"github.com/radcliffetech/midi-lab/go/midi-server/internal/relay"
+	"github.com/radcliffetech/midi-lab/go/midi-server/internal/rtpmidi"
+	"github.com/radcliffetech/midi-lab/go/midi-server/internal/scale"
+	"github.com/radcliffetech/midi-lab/go/midi-server/internal/session"
+	"github.com/radcliffetech/midi-lab/go/midi-server/internal/voices"
+	"github.com/radcliffetech/midi-lab/go/midi-server/internal/wire"
+	"github.com/radcliffetech/midi-lab/go/midi-server/internal/wsconn"
 )
 
 // --------------------
@@ -39,30 +59,70 @@ const (
 
 	idleTimeout   = 5 * time.Minute
 	sceneInterval = 5 * time.Second
+
+	sessionCookie      = "midi_client"
+	maxNicknameLength  = 32
+	rateLimitWindow    = time.Second
+	sessionExpiryCheck = time.Minute
+
+	// hostQueueDepth buffers the raw MIDI stream to a host client; clock
+	// alone is 48 messages a second at 120 BPM.
+	hostQueueDepth = 1024
 )
 
 // --------------------
 // Logging Helpers
 // --------------------
 
+func logAt(level journal.Level, color, prefix, format string, args ...interface{}) {
+	if level < logLevel {
+		return
+	}
+	log.Printf(color+prefix+" "+format+colorReset, args...)
+}
+
 func logServer(format string, args ...interface{}) {
-	log.Printf(colorGreen+"[SERVER] "+format+colorReset, args...)
+	logAt(journal.LevelInfo, colorGreen, "[SERVER]", format, args...)
 }
 
 func logMIDI(format string, args ...interface{}) {
-	log.Printf(colorBlue+"[MIDI] "+format+colorReset, args...)
+	logAt(journal.LevelInfo, colorBlue, "[MIDI]", format, args...)
 }
 
 func logWS(format string, args ...interface{}) {
-	log.Printf(colorCyan+"[WS] "+format+colorReset, args...)
+	logAt(journal.LevelInfo, colorCyan, "[WS]", format, args...)
+}
+
+func logOSC(format string, args ...interface{}) {
+	logAt(journal.LevelInfo, colorWhite, "[OSC]", format, args...)
+}
+
+func logBackplane(format string, args ...interface{}) {
+	logAt(journal.LevelInfo, colorYellow, "[BACKPLANE]", format, args...)
+}
+
+// logNote is used for per-note lines, which dominate output under load and
+// can be turned off with --log-notes=false.
+func logNote(format string, args ...interface{}) {
+	if !logNotes {
+		return
+	}
+	logAt(journal.LevelInfo, colorPurple, "[NOTE]", format, args...)
 }
 
 func logTimeout(format string, args ...interface{}) {
-	log.Printf(colorYellow+"[TIMEOUT] "+format+colorReset, args...)
+	logAt(journal.LevelWarn, colorYellow, "[TIMEOUT]", format, args...)
 }
 
 func logError(format string, args ...interface{}) {
-	log.Printf(colorRed+"[ERROR] "+format+colorReset, args...)
+	logAt(journal.LevelError, colorRed, "[ERROR]", format, args...)
+}
+
+// record writes an entry to the event journal, if one is configured.
+func record(e journal.Entry) {
+	if err := eventJournal.Log(e); err != nil {
+		logAt(journal.LevelError, colorRed, "[ERROR]", "Journal write error: %v", err)
+	}
 }
 
 // --------------------
@@ -70,10 +130,19 @@ func logError(format string, args ...interface{}) {
 // --------------------
 
 type MIDIManager struct {
+	mu           sync.Mutex // the writer's channel is shared state
 	driverCloser io.Closer
 	writer       *writer.Writer
 	out          midi.Out
 	in           midi.In
+	network      *rtpmidi.Session // optional RTP-MIDI session
+	relay        *relay.Relay     // optional host clients playing the output in a browser
+	mirrors      []midiSink       // receive a copy of everything written to the output
+}
+
+// midiSink receives a copy of the raw MIDI output.
+type midiSink interface {
+	Send(msgs ...[]byte) error
 }
 
 func (m *MIDIManager) Setup() error {
@@ -121,18 +190,83 @@ func (m *MIDIManager) Setup() error {
 }
 
 func (m *MIDIManager) Listen() {
-	rdr := reader.New(
+	if m.in == nil {
+		logMIDI("No local MIDI input; not listening")
+		return
+	}
+	options := []func(*reader.Reader){
 		reader.NoteOn(func(pos *reader.Position, channel, key, velocity uint8) {
-			logMIDI("NoteOn: Channel %d, Key %d, Velocity %d", channel, key, velocity)
-			hub.Broadcast <- MIDIMessage{Type: "note", Note: key, Velocity: velocity}
+			logNote("MIDI in NoteOn: Channel %d, Key %d, Velocity %d", channel, key, velocity)
+			hub.Broadcast <- MIDIMessage{Type: "note", Note: key, Velocity: velocity, Channel: channel}
+		}),
+		reader.ControlChange(func(pos *reader.Position, channel, controller, value uint8) {
+			if err := oscOut.Control(channel, controller, value); err != nil {
+				logError("OSC out error: %v", err)
+			}
 		}),
-	)
+	}
+	if clockSource == "midi" {
+		options = append(options,
+			// Clock arrives 24 times per beat; the reader's own
+			// per-message logging would flood the console.
+			reader.NoLogger(),
+			reader.RTClock(func() { hubClock.Pulse(time.Now()) }),
+			reader.RTStart(func() {
+				hubClock.Start()
+				broadcastTransport("start")
+			}),
+			reader.RTStop(func() {
+				hubClock.Stop()
+				broadcastTransport("stop")
+			}),
+			reader.RTContinue(func() {
+				hubClock.Continue()
+				broadcastTransport("continue")
+			}),
+		)
+		logMIDI("Following MIDI clock from input")
+	}
+	rdr := reader.New(options...)
 
 	logMIDI("Listening for MIDI input: %s", m.in.String())
 	rdr.ListenTo(m.in)
 }
 
+// ListenNetwork feeds MIDI arriving from RTP-MIDI peers into the hub the
+// same way as the local input.
+func (m *MIDIManager) ListenNetwork(ctx context.Context) {
+	m.network.OnMIDI = func(msg []byte, from rtpmidi.Peer) {
+		status := msg[0]
+		switch {
+		case status&0xF0 == 0x90 && len(msg) == 3 && msg[2] > 0:
+			logNote("Network MIDI in NoteOn from %s: Channel %d, Key %d, Velocity %d", from.Name, status&0x0F, msg[1], msg[2])
+			hub.Broadcast <- MIDIMessage{Type: "note", Note: msg[1], Velocity: msg[2], Channel: status & 0x0F}
+		case status&0xF0 == 0xB0 && len(msg) == 3:
+			if err := oscOut.Control(status&0x0F, msg[1], msg[2]); err != nil {
+				logError("OSC out error: %v", err)
+			}
+		case clockSource == "midi" && status == clock.StatusClock:
+			hubClock.Pulse(time.Now())
+		case clockSource == "midi" && status == clock.StatusStart:
+			hubClock.Start()
+			broadcastTransport("start")
+		case clockSource == "midi" && status == clock.StatusStop:
+			hubClock.Stop()
+			broadcastTransport("stop")
+		case clockSource == "midi" && status == clock.StatusContinue:
+			hubClock.Continue()
+			broadcastTransport("continue")
+		}
+	}
+	if err := m.network.Serve(ctx); err != nil {
+		logError("RTP-MIDI session error: %v", err)
+	}
+}
+
 func (m *MIDIManager) Close() {
+	if m.network != nil {
+		m.network.Close()
+	}
 	if m.in != nil {
 		m.in.Close()
 	}
@@ -144,26 +278,74 @@ func (m *MIDIManager) Close() {
 	}
 }
 
-func (m *MIDIManager) NoteOn(note uint8, velocity uint8) error {
+// mirror copies msg to the network session and host relay. It reports
+// whether there are any, so output without a local port isn't an error. A
+// sink that fails doesn't stop the others or the local port getting msg.
+func (m *MIDIManager) mirror(msg []byte) (bool, error) {
+	var errs []error
+	for _, sink := range m.mirrors {
+		if err := sink.Send(msg); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return len(m.mirrors) > 0, errors.Join(errs...)
+}
+
+func (m *MIDIManager) NoteOn(channel, note, velocity uint8) error {
+	mirrored, mirrorErr := m.mirror([]byte{0x90 | channel, note, velocity})
 	if m.writer == nil {
+		if mirrored {
+			return mirrorErr
+		}
 		return fmt.Errorf("MIDI writer not initialized")
 	}
-	return writer.NoteOn(m.writer, note, velocity)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.writer.SetChannel(channel)
+	return errors.Join(mirrorErr, writer.NoteOn(m.writer, note, velocity))
 }
 
-func (m *MIDIManager) NoteOff(note uint8) error {
+func (m *MIDIManager) NoteOff(channel, note uint8) error {
+	mirrored, mirrorErr := m.mirror([]byte{0x80 | channel, note, 0})
 	if m.writer == nil {
+		if mirrored {
+			return mirrorErr
+		}
 		return fmt.Errorf("MIDI writer not initialized")
 	}
-	return writer.NoteOff(m.writer, note)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.writer.SetChannel(channel)
+	return errors.Join(mirrorErr, writer.NoteOff(m.writer, note))
+}
+
+// SendRealtime writes a single-byte realtime message such as MIDI clock.
+func (m *MIDIManager) SendRealtime(status byte) error {
+	mirrored, mirrorErr := m.mirror([]byte{status})
+	if m.out == nil {
+		if mirrored {
+			return mirrorErr
+		}
+		return fmt.Errorf("MIDI output not initialized")
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	_, err := m.out.Write([]byte{status})
+	return errors.Join(mirrorErr, err)
 }
 
 // FlushAllNotes sends "All Notes Off" (CC#123) on all MIDI channels.
 func (m *MIDIManager) FlushAllNotes() {
+	for ch := uint8(0); ch < 16; ch++ {
+		m.mirror([]byte{0xB0 | ch, 123, 0})
+	}
 	if m.writer == nil {
 		return
 	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
 	for ch := uint8(0); ch < 16; ch++ {
+		m.writer.SetChannel(ch)
 		writer.ControlChange(m.writer, 123, 0) // CC#123 All Notes Off
 	}
 }
@@ -174,14 +356,37 @@ func (m *MIDIManager) FlushAllNotes() {
 
 var (
 	hub                      *Hub
-	noteStatus               = make(map[uint8]bool) // track active notes
-	noteStatusMutex          sync.Mutex
+	voiceAllocator           *voices.Allocator // tracks sounding notes and enforces polyphony
+	crowd                    = dynamics.NewTracker()
 	midiManager              *MIDIManager
-	upgrader                 = websocket.Upgrader{}
+	upgrader                 = websocket.Upgrader{Subprotocols: []string{wire.SubprotocolCompact}}
 	noteEventsThisPeriod     int64
+	connectionCount          uint64 // numbers client connections
 	newConnectionsThisPeriod int64
+	sceneMu                  sync.Mutex // guards scenes, currentScene and sceneSeq
 	scenes                   []Scene
 	currentScene             int
+	sceneSeq                 uint64 // counts scene changes across instances
+	eventJournal             *journal.Journal
+	logLevel                 = journal.LevelInfo
+	logNotes                 = true
+	sessions                 *session.Store
+	clientRateLimit          int
+	groupAssigner            *groups.Assigner
+	followClock              bool
+	clockSource              string
+	hubClock                 *clock.Clock
+	oscOut                   *osc.Sender // nil unless --osc-out is set
+	relayKey                 string
+	wsConfig                 = wsconn.Default
+	clientQueueDepth         = 64
+	clientQueuePolicy        = broadcast.DropOldest
+	broadcaster              *broadcast.Switchable    // the hub's; swapped from /admin/broadcast
+	broadcastConfig          broadcastSettings        // what broadcaster is running
+	broadcastMu              sync.Mutex               // guards broadcastConfig and swaps
+	bus                      backplane.Backplane      // nil unless --backplane is set
+	instanceID               string                   // names this instance on the backplane
+	sceneMoved               = make(chan struct{}, 1) // another instance changed the scene
 )
 
 // --------------------
@@ -189,66 +394,271 @@ var (
 // --------------------
 
 type WebSocketClient struct {
-	Conn  *websocket.Conn
-	Send  chan interface{}
-	Timer *time.Timer
-	Once  sync.Once
+	ID      string // unique per connection; a session may have several
+	Conn    *websocket.Conn
+	Send    *broadcast.Queue
+	Timer   *time.Timer
+	Once    sync.Once
+	Session *session.Session
+	Codec   wire.Codec // JSON, or compact if negotiated
+
+	link *wsconn.Conn // Conn with keepalive and deadlines; use it for I/O
 }
 
+// Group returns the audience group the client belongs to, or nil.
+func (c *WebSocketClient) Group() *groups.Group {
+	if groupAssigner == nil {
+		return nil
+	}
+	g, _ := groupAssigner.Lookup(c.Session.Group())
+	return g
+}
+
+// Close disconnects a client that can't keep up with broadcasts.
 func (c *WebSocketClient) Close() {
+	c.release(func() {
+		summary := deliverySummary(c.Send.Stats())
+		logWS("Closing slow client %s: %s", c.ID, summary)
+		record(journal.Entry{Level: journal.LevelWarn, Event: "slow_client", ClientID: c.Session.ID, Message: summary})
+		c.link.CloseWith(websocket.CloseTryAgainLater, "too slow")
+	})
+}
+
+// CloseWith disconnects the client with a close code and reason.
+func (c *WebSocketClient) CloseWith(code int, reason string) {
+	c.release(func() { c.link.CloseWith(code, reason) })
+}
+
+// drop disconnects a client whose connection has already failed.
+func (c *WebSocketClient) drop() {
+	c.release(func() { c.link.Close() })
+}
+
+func (c *WebSocketClient) release(closeConn func()) {
 	c.Once.Do(func() {
 		c.Timer.Stop()
-		close(c.Send)
-		c.Conn.Close()
+		c.Send.Close()
+		closeConn()
 		hub.Unregister(c)
+		sessions.Release(c.Session)
+		record(journal.Entry{Level: journal.LevelDebug, Event: "delivery", ClientID: c.Session.ID, Message: deliverySummary(c.Send.Stats())})
 	})
 }
 
-func (c *WebSocketClient) SendChannel() chan interface{} {
+// deliverySummary describes a client's queue for logs and the journal.
+func deliverySummary(s broadcast.QueueStats) string {
+	return fmt.Sprintf("delivered %d of %d, dropped %d, queue high water %d/%d, last write %.1fms",
+		s.Delivered, s.Sent, s.Dropped, s.HighWater, s.Capacity, s.LastWrite)
+}
+
+// write stamps msg with the envelope and writes it to the socket. seq is
+// the number the queue gave it. Only the writer goroutine may call it.
+func (c *WebSocketClient) write(msg interface{}, seq uint64) error {
+	messageType, data, err := c.Codec.Encode(msg, wire.Header{Seq: seq, Time: time.Now()})
+	if err != nil {
+		logError("Encode error: %v", err)
+		return nil
+	}
+	return c.link.WriteMessage(messageType, data)
+}
+
+// resync sends the current group and scene again after the client's queue
+// had to discard one of them.
+func (c *WebSocketClient) resync() {
+	logWS("Client %s fell behind, resending its scene", c.Session.ID)
+	record(journal.Entry{Level: journal.LevelWarn, Event: "resync", ClientID: c.Session.ID})
+	if groupAssigner != nil {
+		c.Enqueue(newGroupMessage(c.Group()))
+	}
+	if sc := activeScene(); sc != nil {
+		c.Enqueue(newCueMessage(*sc, c.Group()))
+	}
+}
+
+// Enqueue queues msg for this client alone, disconnecting the client if its overflow policy
+// says to.
+func (c *WebSocketClient) Enqueue(msg interface{}) {
+	if !c.Send.Push(msg) {
+		c.Close()
+	}
+}
+
+// replyError sends an ErrorMessage and records it in the journal.
+func (c *WebSocketClient) replyError(code, ref, format string, args ...interface{}) {
+	msg := fmt.Sprintf(format, args...)
+	record(journal.Entry{Level: journal.LevelWarn, Event: "client_error", ClientID: c.Session.ID, Message: code + ": " + msg})
+	c.Enqueue(ErrorMessage{Type: "error", Code: code, Message: msg, Ref: ref})
+}
+
+func (c *WebSocketClient) SendQueue() *broadcast.Queue {
 	return c.Send
 }
 
 type Hub struct {
+	mu          sync.RWMutex
 	Clients     map[*websocket.Conn]*WebSocketClient
 	Broadcast   chan interface{}
 	Shutdown    chan struct{}
 	Broadcaster broadcast.Broadcaster
+
+	// Quantizer, when set, holds client notes back until the next grid
+	// point. Quantized notes and the later notes of effects re-enter the
+	// hub through Delayed.
+	Quantizer *quantize.Quantizer
+	Delayed   chan interface{}
+
+	// Remote carries traffic from other instances on the backplane. It is
+	// handled like Broadcast but not shared again.
+	Remote chan interface{}
 }
 
 type IncomingMessage struct {
 	Type     string `json:"type"`
 	Note     *uint8 `json:"note,omitempty"`
 	Velocity *uint8 `json:"velocity,omitempty"`
+	Nickname string `json:"nickname,omitempty"`
+
+	// Sent with "hello".
+	Version      int      `json:"version,omitempty"`
+	Capabilities []string `json:"capabilities,omitempty"`
+
+	// Optional touch data for scenes that derive velocity from it:
+	// pressure in 0-1 and press duration in milliseconds.
+	Pressure *float64 `json:"pressure,omitempty"`
+	Duration *float64 `json:"duration,omitempty"`
 }
 
+// MIDIMessage is a note event. From, Nickname and Group identify the client
+// that pressed the pad and are empty for notes coming from MIDI input.
 type MIDIMessage struct {
 	Type     string `json:"type"`
 	Note     uint8  `json:"note"`
 	Velocity uint8  `json:"velocity"`
+	Channel  uint8  `json:"channel"`
+	From     string `json:"from,omitempty"`
+	Nickname string `json:"nickname,omitempty"`
+	Group    string `json:"group,omitempty"`
+	At       int64  `json:"at,omitempty"` // quantized play time, Unix milliseconds
+
+	expanded bool // effects have already been applied
+	repeat   bool // a later note of an effect, which retriggers the pitch
+	pressure *float64
+	duration *float64
 }
 
-type CueMessage struct {
-	Type string `json:"type"`
-	Text string `json:"text"`
+// MIDIBytes is the note-on sent to compact-protocol clients.
+func (m MIDIMessage) MIDIBytes() ([]byte, bool) {
+	if m.Type != "note" {
+		return nil, false
+	}
+	return []byte{0x90 | m.Channel, m.Note, m.Velocity}, true
 }
 
-type UpdateLabelMessage struct {
-	Type  string `json:"type"`
-	Note  uint8  `json:"note"`
-	Label string `json:"label"`
+// CoalesceKey lets a backed-up client keep only the latest hit per pad.
+func (m MIDIMessage) CoalesceKey() string {
+	return fmt.Sprintf("%s/%d/%d", m.Type, m.Channel, m.Note)
+}
+
+// Priority lets note flashes be dropped for clients that fall behind.
+func (m MIDIMessage) Priority() broadcast.Priority { return broadcast.Ephemeral }
+
+// IdentityMessage tells a client who it is. Token is private to that client
+// and can be presented as ?token= (or the midi_client cookie) to resume.
+type IdentityMessage struct {
+	Type     string `json:"type"`
+	ID       string `json:"id"`
+	Token    string `json:"token"`
+	Nickname string `json:"nickname,omitempty"`
+	Resumed  bool   `json:"resumed"`
 }
 
-type BulkLabelUpdateMessage struct {
-	Type   string           `json:"type"`
-	Labels map[uint8]string `json:"labels"`
+// GroupMessage tells a client which group it is in and which pads it has.
+// An empty Name means the client is unassigned and may play every pad.
+type GroupMessage struct {
+	Type    string  `json:"type"`
+	Name    string  `json:"name"`
+	Pads    []uint8 `json:"pads,omitempty"`
+	Channel uint8   `json:"channel,omitempty"`
+	Color   string  `json:"color,omitempty"`
+}
+
+func newGroupMessage(g *groups.Group) GroupMessage {
+	if g == nil {
+		return GroupMessage{Type: "group"}
+	}
+	return GroupMessage{Type: "group", Name: g.Name, Pads: g.Pads, Channel: g.Channel, Color: g.Color}
+}
+
+func (m GroupMessage) CoalesceKey() string { return m.Type }
+
+// BeatMessage is broadcast on every beat of the hub clock so clients can
+// flash in time with the band. Bar and BeatInBar count from 1.
+type BeatMessage struct {
+	Type      string  `json:"type"`
+	Beat      int     `json:"beat"`
+	Bar       int     `json:"bar"`
+	BeatInBar int     `json:"beatInBar"`
+	BPM       float64 `json:"bpm"`
+	At        int64   `json:"at"` // Unix milliseconds
+}
+
+func (m BeatMessage) CoalesceKey() string { return m.Type }
+
+func (m BeatMessage) Priority() broadcast.Priority { return broadcast.Ephemeral }
+
+// WelcomeMessage answers a client's hello with what this server speaks. The
+// protocol version it speaks is the envelope's.
+type WelcomeMessage struct {
+	Type         string   `json:"type"`
+	Server       string   `json:"server"`
+	MinVersion   int      `json:"minVersion"`
+	Protocol     string   `json:"protocol"` // json or the negotiated subprotocol
+	Capabilities []string `json:"capabilities"`
+}
+
+// ErrorMessage reports a client message the server could not act on.
+type ErrorMessage struct {
+	Type    string `json:"type"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+	Ref     string `json:"ref,omitempty"` // type of the offending message, if known
+}
+
+// Error codes sent in ErrorMessage.
+const (
+	errMalformed          = "malformed"
+	errUnknownType        = "unknown_type"
+	errUnsupportedVersion = "unsupported_version"
+)
+
+// TransportMessage announces MIDI start, stop and continue.
+type TransportMessage struct {
+	Type  string `json:"type"`
+	State string `json:"state"`
 }
 
-type FullSceneMessage struct {
+func (m TransportMessage) CoalesceKey() string { return m.Type }
+
+type CueMessage struct {
 	Type        string           `json:"type"`
-	Cue         string           `json:"cue"`
-	Labels      map[uint8]string `json:"labels"`
-	NormalColor string           `json:"normalColor"`
-	PressColor  string           `json:"pressColor"`
+	Text        string           `json:"text"`
+	Labels      map[uint8]string `json:"labels,omitempty"`
+	NormalColor string           `json:"normalColor,omitempty"`
+	PressColor  string           `json:"pressColor,omitempty"`
+}
+
+func (m CueMessage) CoalesceKey() string { return m.Type }
+
+// newCueMessage is scene as group sees it: each group only sees the labels
+// for its own pads.
+func newCueMessage(scene Scene, g *groups.Group) CueMessage {
+	return CueMessage{
+		Type:        "cue",
+		Text:        scene.Cue,
+		Labels:      g.FilterLabels(scene.Labels),
+		NormalColor: scene.NormalColor,
+		PressColor:  scene.PressColor,
+	}
 }
 
 type Scene struct {
@@ -256,6 +666,50 @@ type Scene struct {
 	Labels      map[uint8]string
 	NormalColor string
 	PressColor  string
+
+	// Optional musical constraint for client notes. ScaleMode "snap" (the
+	// default) moves each note to the nearest in-scale pitch; "degree" maps
+	// the n-th pad to the n-th scale degree above the lowest pad.
+	Key       string
+	Scale     string
+	ScaleMode string
+
+	// Optional chord, arpeggio and echo applied to client notes.
+	Effects *effects.Config
+
+	// Optional velocity curve, touch source and crowd boost for client notes.
+	Velocity *dynamics.Config
+
+	constraint *scale.Scale
+	pads       []uint8 // sorted pad notes, for degree mode
+}
+
+// constrain applies the scene's key and scale to a client note.
+func (sc *Scene) constrain(note uint8) uint8 {
+	if sc == nil || sc.constraint == nil {
+		return note
+	}
+	if sc.ScaleMode == "degree" {
+		for i, p := range sc.pads {
+			if p == note {
+				return sc.constraint.Degree(i, sc.pads[0])
+			}
+		}
+	}
+	return sc.constraint.Snap(note)
+}
+
+// shape applies the scene's velocity curve to a client note, counting the
+// press in tracker for crowd intensity.
+func (sc *Scene) shape(m MIDIMessage, tracker *dynamics.Tracker, now time.Time) uint8 {
+	if sc == nil || sc.Velocity == nil {
+		return m.Velocity
+	}
+	presses := 1
+	if window := sc.Velocity.CrowdWindow(); window > 0 {
+		presses = tracker.Press(m.Note, now, window)
+	}
+	return sc.Velocity.Shape(dynamics.Touch{Velocity: m.Velocity, Pressure: m.pressure, Duration: m.duration}, presses)
 }
 
 // --------------------
@@ -275,38 +729,430 @@ func loadScenesFromFile(path string) ([]Scene, error) {
 		return nil, err
 	}
 
+	for i := range loadedScenes {
+		sc := &loadedScenes[i]
+		if sc.Velocity != nil {
+			if err := sc.Velocity.Validate(); err != nil {
+				return nil, fmt.Errorf("scene %q: %v", sc.Cue, err)
+			}
+		}
+		if sc.Effects != nil {
+			if err := sc.Effects.Validate(); err != nil {
+				return nil, fmt.Errorf("scene %q: %v", sc.Cue, err)
+			}
+		}
+		if sc.Scale == "" {
+			continue
+		}
+		if sc.Key == "" {
+			sc.Key = "C"
+		}
+		sc.constraint, err = scale.Parse(sc.Key, sc.Scale)
+		if err != nil {
+			return nil, fmt.Errorf("scene %q: %v", sc.Cue, err)
+		}
+		switch sc.ScaleMode {
+		case "", "snap", "degree":
+		default:
+			return nil, fmt.Errorf("scene %q: unknown scaleMode %q", sc.Cue, sc.ScaleMode)
+		}
+		for note := range sc.Labels {
+			sc.pads = append(sc.pads, note)
+		}
+		sort.Slice(sc.pads, func(a, b int) bool { return sc.pads[a] < sc.pads[b] })
+	}
+
 	return loadedScenes, nil
 }
 
+// activeScene returns the scene most recently broadcast to clients, or nil
+// before the first broadcast.
+func activeScene() *Scene {
+	sceneMu.Lock()
+	defer sceneMu.Unlock()
+	if len(scenes) == 0 || currentScene == 0 {
+		return nil
+	}
+	return &scenes[(currentScene-1)%len(scenes)]
+}
+
+// activeCue returns the cue text of the scene showing now, or "" before the
+// first scene.
+func activeCue() string {
+	if sc := activeScene(); sc != nil {
+		return sc.Cue
+	}
+	return ""
+}
+
+// currentCue returns the cue text of the scene that will be broadcast next.
+func currentCue() string {
+	sceneMu.Lock()
+	defer sceneMu.Unlock()
+	if len(scenes) == 0 {
+		return ""
+	}
+	return scenes[currentScene%len(scenes)].Cue
+}
+
 func broadcastScene() {
+	moveScene(func(current, count int) int { return current%count + 1 })
+}
+
+// goToScene broadcasts the 1-based scene number, wrapping past the end.
+func goToScene(number int) {
+	moveScene(func(_, count int) int { return (number-1)%count + 1 })
+}
+
+// moveScene makes the scene pick chooses current and sends it to this
+// instance's clients and the other instances.
+func moveScene(pick func(current, count int) int) {
+	sceneMu.Lock()
 	if len(scenes) == 0 {
+		sceneMu.Unlock()
 		logServer("No scenes to broadcast")
 		return
 	}
+	number := pick(currentScene, len(scenes))
+	scene := scenes[number-1]
+	currentScene = number
+	sceneSeq++
+	seq := sceneSeq
+	sceneMu.Unlock()
+
+	showScene(number, scene)
+	publishShared(sharedMessage{Scene: number, Seq: seq})
+}
 
-	scene := scenes[currentScene%len(scenes)]
-	currentScene++
-
+// showScene sends scene, which has just become current as the 1-based
+// number, to this instance's clients. Clients may close while it runs, so
+// it must not be called with sceneMu held.
+func showScene(number int, scene Scene) {
 	logServer("Broadcasting scene: %s", scene.Cue)
+	record(journal.Entry{Level: journal.LevelInfo, Event: "scene", Scene: scene.Cue})
+	if err := oscOut.Scene(number, scene.Cue); err != nil {
+		logError("OSC out error: %v", err)
+	}
 
-	fullScene := map[string]interface{}{
-		"type":        "cue",
-		"text":        scene.Cue,
-		"labels":      scene.Labels,
-		"normalColor": scene.NormalColor,
-		"pressColor":  scene.PressColor,
+	for _, client := range hub.Snapshot() {
+		client.Enqueue(newCueMessage(scene, client.Group()))
 	}
 
-	for _, client := range hub.Clients {
-		select {
-		case client.Send <- fullScene:
+	atomic.StoreInt64(&noteEventsThisPeriod, 0)
+	atomic.StoreInt64(&newConnectionsThisPeriod, 0)
+}
+
+// --------------------
+// OSC Handling
+// --------------------
+
+// oscHandlers route incoming OSC into the hub like MIDI input.
+func oscHandlers() osc.Handlers {
+	return osc.Handlers{
+		Note: func(channel, note, velocity uint8) {
+			logNote("OSC in Note: Channel %d, Key %d, Velocity %d", channel, note, velocity)
+			hub.Broadcast <- MIDIMessage{Type: "note", Note: note, Velocity: velocity, Channel: channel}
+		},
+		Scene: func(number int) {
+			record(journal.Entry{Level: journal.LevelInfo, Event: "osc_scene", Message: fmt.Sprint(number)})
+			if number == 0 {
+				broadcastScene()
+				return
+			}
+			goToScene(number)
+		},
+		Unknown: func(m osc.Message) {
+			logAt(journal.LevelDebug, colorWhite, "[OSC]", "Ignoring %s %v", m.Address, m.Args)
+		},
+	}
+}
+
+// --------------------
+// Clock Handling
+// --------------------
+
+// onBeat keeps the quantizer on the clock and tells clients about the beat.
+func onBeat(b clock.Beat) {
+	if followClock && hub.Quantizer != nil {
+		hub.Quantizer.SetTempo(b.BPM)
+		hub.Quantizer.Align(b.Time)
+	}
+	hub.Broadcast <- BeatMessage{
+		Type:      "beat",
+		Beat:      b.Count,
+		Bar:       b.Bar,
+		BeatInBar: b.BeatInBar,
+		BPM:       b.BPM,
+		At:        b.Time.UnixMilli(),
+	}
+}
+
+func broadcastTransport(state string) {
+	logMIDI("Transport %s", state)
+	record(journal.Entry{Level: journal.LevelInfo, Event: "transport", Message: state})
+	hub.Broadcast <- TransportMessage{Type: "transport", State: state}
+}
+
+// --------------------
+// Backplane
+// --------------------
+
+// backplaneSubject carries hub traffic between instances.
+const backplaneSubject = "midi-lab.hub"
+
+// sharedMessage is hub traffic as it travels between instances. One of the
+// payload fields is set.
+type sharedMessage struct {
+	Origin    string            `json:"origin"`
+	Note      *sharedNote       `json:"note,omitempty"`
+	Beat      *BeatMessage      `json:"beat,omitempty"`
+	Transport *TransportMessage `json:"transport,omitempty"`
+	Scene     int               `json:"scene,omitempty"` // 1-based scene now showing
+	Seq       uint64            `json:"seq,omitempty"`   // the scene change's sceneSeq
+	Sync      bool              `json:"sync,omitempty"`  // asks the others for the current scene
+}
+
+// sharedNote is a note entering the hub, with the touch data that shapes
+// its velocity.
+type sharedNote struct {
+	MIDIMessage
+	Pressure *float64 `json:"pressure,omitempty"`
+	Duration *float64 `json:"duration,omitempty"`
+}
+
+// share sends a message entering the hub from this instance to the others,
+// which handle it as if it came from one of their own sources.
+func share(msg interface{}) {
+	if bus == nil {
+		return
+	}
+	switch m := msg.(type) {
+	case MIDIMessage:
+		publishShared(sharedMessage{Note: &sharedNote{MIDIMessage: m, Pressure: m.pressure, Duration: m.duration}})
+	case BeatMessage:
+		publishShared(sharedMessage{Beat: &m})
+	case TransportMessage:
+		publishShared(sharedMessage{Transport: &m})
+	}
+}
+
+func publishShared(m sharedMessage) {
+	if bus == nil {
+		return
+	}
+	m.Origin = instanceID
+	data, err := json.Marshal(m)
+	if err != nil {
+		logError("Backplane encode error: %v", err)
+		return
+	}
+	// Failures are counted in the backplane's stats; logging each one
+	// would flood the console while it reconnects.
+	if err := bus.Publish(backplaneSubject, data); err != nil {
+		logAt(journal.LevelDebug, colorYellow, "[BACKPLANE]", "Publish error: %v", err)
+	}
+}
+
+// receiveShared handles traffic from other instances.
+func receiveShared(subject string, data []byte) {
+	var m sharedMessage
+	if err := json.Unmarshal(data, &m); err != nil {
+		logError("Backplane decode error: %v", err)
+		return
+	}
+	if m.Origin == instanceID {
+		return
+	}
+	switch {
+	case m.Note != nil:
+		note := m.Note.MIDIMessage
+		note.pressure, note.duration = m.Note.Pressure, m.Note.Duration
+		hub.Remote <- note
+	case m.Beat != nil:
+		hub.Remote <- *m.Beat
+	case m.Transport != nil:
+		hub.Remote <- *m.Transport
+	case m.Scene > 0:
+		followScene(m.Origin, m.Scene, m.Seq)
+	case m.Sync:
+		publishScene()
+	}
+}
+
+// publishScene tells the other instances which scene is showing here.
+func publishScene() {
+	sceneMu.Lock()
+	number, seq := 0, sceneSeq
+	if currentScene > 0 && len(scenes) > 0 {
+		number = (currentScene-1)%len(scenes) + 1
+	}
+	sceneMu.Unlock()
+	if number > 0 {
+		publishShared(sharedMessage{Scene: number, Seq: seq})
+	}
+}
+
+// followScene shows a scene another instance moved to, unless it is
+// already showing here. A change older than the last one seen here, such as
+// a late answer to a sync, is answered with the current scene instead, so
+// instances don't flip each other back; of two changes made at once, the
+// one from the instance with the lower ID wins.
+func followScene(origin string, number int, seq uint64) {
+	sceneMu.Lock()
+	if number > len(scenes) {
+		count := len(scenes)
+		sceneMu.Unlock()
+		logError("Instance %s is on scene %d but only %d are loaded here", origin, number, count)
+		return
+	}
+	changed := currentScene == 0 || (currentScene-1)%len(scenes)+1 != number
+	if seq < sceneSeq || seq == sceneSeq && changed && origin > instanceID {
+		sceneMu.Unlock()
+		logAt(journal.LevelDebug, colorYellow, "[BACKPLANE]", "Ignoring stale scene %d from %s", number, origin)
+		publishScene()
+		return
+	}
+	sceneSeq = seq
+	currentScene = number
+	scene := scenes[number-1]
+	sceneMu.Unlock()
+
+	if changed {
+		record(journal.Entry{Level: journal.LevelInfo, Event: "remote_scene", Message: origin})
+		showScene(number, scene)
+	}
+	select {
+	case sceneMoved <- struct{}{}:
+	default:
+	}
+}
+
+// defaultInstanceID names an instance after its host and process.
+func defaultInstanceID() string {
+	host, err := os.Hostname()
+	if err != nil {
+		host = "midi-server"
+	}
+	return fmt.Sprintf("%s-%d", host, os.Getpid())
+}
+
+// joinBackplane subscribes to hub traffic and asks the others where the
+// show is.
+func joinBackplane() error {
+	if err := bus.Subscribe(backplaneSubject, receiveShared); err != nil {
+		return err
+	}
+	publishShared(sharedMessage{Sync: true})
+	return nil
+}
+
+// --------------------
+// Broadcast Settings
+// --------------------
+
+// broadcastSettings selects the hub's broadcaster and tunes it. Zero
+// parameters leave the broadcaster's own defaults.
+type broadcastSettings struct {
+	Mode        string
+	Window      time.Duration // coalesce
+	Workers     int           // sharded
+	BufferedLag float64       // adaptive
+	LossyLag    float64       // adaptive
+	LossyFanOut time.Duration // adaptive
+	Hold        time.Duration // adaptive
+}
+
+// newBroadcaster builds the broadcaster s describes.
+func (s broadcastSettings) newBroadcaster() (broadcast.Broadcaster, error) {
+	switch s.Mode {
+	case "buffered":
+		return &broadcast.BufferedBroadcaster{}, nil
+	case "default":
+		return &broadcast.DefaultBroadcaster{}, nil
+	case "batch":
+		return &broadcast.BatchBroadcaster{}, nil
+	case "lossy":
+		return &broadcast.LossyBroadcaster{}, nil
+	case "sharded":
+		return &broadcast.ShardedBroadcaster{Workers: s.Workers}, nil
+	case "adaptive":
+		return &broadcast.AdaptiveBroadcaster{
+			BufferedLag: s.BufferedLag,
+			LossyLag:    s.LossyLag,
+			LossyFanOut: s.LossyFanOut,
+			Hold:        s.Hold,
+			OnSwitch: func(s broadcast.Switch) {
+				logWS("Broadcast mode %s -> %s (%s)", s.From, s.To, s.Reason)
+				record(journal.Entry{Level: journal.LevelInfo, Event: "broadcast_mode", Message: fmt.Sprintf("%s -> %s: %s", s.From, s.To, s.Reason)})
+			},
+		}, nil
+	case "coalesce":
+		return &broadcast.CoalescingBroadcaster{Window: s.Window, Next: &broadcast.BufferedBroadcaster{}}, nil
+	}
+	return nil, fmt.Errorf("unknown broadcast mode %q", s.Mode)
+}
+
+// apply overrides settings with those given in q, by the names
+// /admin/broadcast takes.
+func (s *broadcastSettings) apply(q url.Values) error {
+	for name := range q {
+		v := q.Get(name)
+		var err error
+		switch name {
+		case "mode":
+			s.Mode = v
+		case "coalesce_window":
+			s.Window, err = time.ParseDuration(v)
+		case "workers":
+			s.Workers, err = strconv.Atoi(v)
+		case "buffered_lag":
+			s.BufferedLag, err = strconv.ParseFloat(v, 64)
+		case "lossy_lag":
+			s.LossyLag, err = strconv.ParseFloat(v, 64)
+		case "lossy_fan_out":
+			s.LossyFanOut, err = time.ParseDuration(v)
+		case "hold":
+			s.Hold, err = time.ParseDuration(v)
 		default:
-			client.Close()
+			return fmt.Errorf("unknown parameter %s", name)
+		}
+		if err != nil {
+			return fmt.Errorf("invalid %s: %v", name, err)
 		}
 	}
+	return nil
+}
 
-	atomic.StoreInt64(&noteEventsThisPeriod, 0)
-	atomic.StoreInt64(&newConnectionsThisPeriod, 0)
+// String describes the mode and whichever of its parameters are set.
+func (s broadcastSettings) String() string {
+	var params []string
+	switch s.Mode {
+	case "coalesce":
+		if s.Window > 0 {
+			params = append(params, fmt.Sprintf("window %v", s.Window))
+		}
+	case "sharded":
+		if s.Workers > 0 {
+			params = append(params, fmt.Sprintf("%d workers", s.Workers))
+		}
+	case "adaptive":
+		if s.BufferedLag > 0 {
+			params = append(params, fmt.Sprintf("buffered at %.2f", s.BufferedLag))
+		}
+		if s.LossyLag > 0 {
+			params = append(params, fmt.Sprintf("lossy at %.2f", s.LossyLag))
+		}
+		if s.LossyFanOut > 0 {
+			params = append(params, fmt.Sprintf("lossy over %v", s.LossyFanOut))
+		}
+		if s.Hold > 0 {
+			params = append(params, fmt.Sprintf("hold %v", s.Hold))
+		}
+	}
+	if len(params) == 0 {
+		return s.Mode
+	}
+	return s.Mode + " (" + strings.Join(params, ", ") + ")"
 }
 
 // --------------------
@@ -315,34 +1161,63 @@ func broadcastScene() {
 
 func statsHandler(w http.ResponseWriter, r *http.Request) {
 	type Stats struct {
-		ConnectedClients     int    `json:"connected_clients"`
-		ActiveNotes          int    `json:"active_notes"`
-		Cue                  string `json:"cue"`
-		NotesPerPeriod       int    `json:"notes_per_period"`
-		ConnectionsPerPeriod int    `json:"connections_per_period"`
+		ConnectedClients     int                      `json:"connected_clients"`
+		Sessions             int                      `json:"sessions"`
+		ActiveNotes          int                      `json:"active_notes"`
+		Cue                  string                   `json:"cue"`
+		NotesPerPeriod       int                      `json:"notes_per_period"`
+		ConnectionsPerPeriod int                      `json:"connections_per_period"`
+		ClockSource          string                   `json:"clock_source,omitempty"`
+		ClockRunning         bool                     `json:"clock_running"`
+		Tempo                float64                  `json:"tempo,omitempty"`
+		Voices               voices.Stats             `json:"voices"`
+		NetworkPeers         []string                 `json:"network_peers,omitempty"`
+		Relay                *relay.Stats             `json:"relay,omitempty"`
+		BroadcastMode        string                   `json:"broadcast_mode"`
+		Broadcast            *broadcast.AdaptiveStats `json:"broadcast,omitempty"`
+		Instance             string                   `json:"instance,omitempty"`
+		Backplane            *backplane.Stats         `json:"backplane,omitempty"`
 	}
 
-	noteStatusMutex.Lock()
-	activeNotes := 0
-	for _, active := range noteStatus {
-		if active {
-			activeNotes++
-		}
-	}
-	noteStatusMutex.Unlock()
+	voiceStats := voiceAllocator.Stats()
 
-	cue := ""
-	if len(scenes) > 0 {
-		cue = scenes[currentScene%len(scenes)].Cue
-	}
+	cue := currentCue()
 
 	stats := Stats{
-		ConnectedClients:     len(hub.Clients),
-		ActiveNotes:          activeNotes,
+		ConnectedClients:     hub.Len(),
+		Sessions:             sessions.Len(),
+		ActiveNotes:          voiceStats.Active,
+		Voices:               voiceStats,
 		Cue:                  cue,
 		NotesPerPeriod:       int(atomic.LoadInt64(&noteEventsThisPeriod)),
 		ConnectionsPerPeriod: int(atomic.LoadInt64(&newConnectionsThisPeriod)),
 	}
+	if hubClock != nil {
+		stats.ClockSource = clockSource
+		stats.ClockRunning = hubClock.Running()
+		stats.Tempo = hubClock.Tempo()
+	}
+	broadcastMu.Lock()
+	stats.BroadcastMode = broadcastConfig.Mode
+	broadcastMu.Unlock()
+	if adaptive, ok := broadcaster.Current().(*broadcast.AdaptiveBroadcaster); ok {
+		broadcastStats := adaptive.Stats()
+		stats.Broadcast = &broadcastStats
+	}
+	if bus != nil {
+		backplaneStats := bus.Stats()
+		stats.Instance = instanceID
+		stats.Backplane = &backplaneStats
+	}
+	if midiManager != nil && midiManager.relay != nil {
+		relayStats := midiManager.relay.Stats()
+		stats.Relay = &relayStats
+	}
+	if midiManager != nil && midiManager.network != nil {
+		for _, p := range midiManager.network.Peers() {
+			stats.NetworkPeers = append(stats.NetworkPeers, p.Name)
+		}
+	}
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(stats)
@@ -355,139 +1230,551 @@ func reloadScenesHandler(w http.ResponseWriter, r *http.Request) {
 		logError("Failed to reload scenes: %v", err)
 		return
 	}
+	sceneMu.Lock()
 	scenes = sc
+	sceneMu.Unlock()
 	logServer("Reloaded scenes from scenes.json")
+	record(journal.Entry{Level: journal.LevelInfo, Event: "reload", Message: fmt.Sprintf("loaded %d scenes", len(sc))})
 	w.WriteHeader(http.StatusOK)
 	w.Write([]byte("Scenes reloaded successfully"))
 }
 
-// --------------------
-// WebSocket Handling
-// --------------------
-
+// groupsHandler lists the configured groups with their connected members.
+func groupsHandler(w http.ResponseWriter, r *http.Request) {
+	type Member struct {
+		ID       string `json:"id"`
+		Nickname string `json:"nickname,omitempty"`
+	}
+	type GroupInfo struct {
+		groups.Group
+		Members []Member `json:"members"`
+	}
+	type Response struct {
+		Mode       groups.Mode `json:"mode"`
+		Groups     []GroupInfo `json:"groups"`
+		Unassigned []Member    `json:"unassigned"`
+	}
+
+	resp := Response{Unassigned: []Member{}}
+	byName := make(map[string]int)
+	if groupAssigner != nil {
+		resp.Mode = groupAssigner.Mode()
+		for i, g := range groupAssigner.Groups() {
+			byName[g.Name] = i
+			resp.Groups = append(resp.Groups, GroupInfo{Group: g, Members: []Member{}})
+		}
+	}
+	for _, client := range hub.Snapshot() {
+		m := Member{ID: client.Session.ID, Nickname: client.Session.Nickname()}
+		if i, ok := byName[client.Session.Group()]; ok {
+			resp.Groups[i].Members = append(resp.Groups[i].Members, m)
+		} else {
+			resp.Unassigned = append(resp.Unassigned, m)
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// assignGroupHandler moves a connected client into a group:
+// POST /admin/assign?client=<id>&group=<name>. An empty group unassigns.
+func assignGroupHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "POST required", http.StatusMethodNotAllowed)
+		return
+	}
+	if groupAssigner == nil {
+		http.Error(w, "Groups are not configured", http.StatusNotFound)
+		return
+	}
+
+	clientID := r.URL.Query().Get("client")
+	name := r.URL.Query().Get("group")
+	group, ok := groupAssigner.Lookup(name)
+	if !ok && name != "" {
+		http.Error(w, "Unknown group", http.StatusNotFound)
+		return
+	}
+
+	assigned := 0
+	for _, client := range hub.Snapshot() {
+		if client.Session.ID != clientID {
+			continue
+		}
+		client.Session.SetGroup(name)
+		client.Enqueue(newGroupMessage(group))
+		assigned++
+	}
+	if assigned == 0 {
+		http.Error(w, "Unknown client", http.StatusNotFound)
+		return
+	}
+
+	logServer("Assigned client %s to group %q", clientID, name)
+	record(journal.Entry{Level: journal.LevelInfo, Event: "assign", ClientID: clientID, Message: name})
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("Client assigned"))
+}
+
+// broadcastHandler reports the hub's broadcaster, or on POST replaces it
+// without dropping anyone: POST /admin/broadcast?mode=lossy. Parameters
+// left out of a POST keep their current values.
+func broadcastHandler(w http.ResponseWriter, r *http.Request) {
+	type Response struct {
+		Mode           string  `json:"mode"`
+		CoalesceWindow string  `json:"coalesce_window,omitempty"`
+		Workers        int     `json:"workers,omitempty"`
+		BufferedLag    float64 `json:"buffered_lag,omitempty"`
+		LossyLag       float64 `json:"lossy_lag,omitempty"`
+		LossyFanOut    string  `json:"lossy_fan_out,omitempty"`
+		Hold           string  `json:"hold,omitempty"`
+		Clients        int     `json:"clients"`
+	}
+	if r.Method != http.MethodGet && r.Method != http.MethodPost {
+		http.Error(w, "GET or POST required", http.StatusMethodNotAllowed)
+		return
+	}
+
+	broadcastMu.Lock()
+	defer broadcastMu.Unlock()
+	if r.Method == http.MethodPost {
+		next := broadcastConfig
+		err := next.apply(r.URL.Query())
+		var b broadcast.Broadcaster
+		if err == nil {
+			b, err = next.newBroadcaster()
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		broadcaster.Swap(b)
+		broadcastConfig = next
+		logServer("Broadcast mode set to %s", next)
+		record(journal.Entry{Level: journal.LevelInfo, Event: "broadcaster", Message: next.String()})
+	}
+
+	s := broadcastConfig
+	resp := Response{
+		Mode:        s.Mode,
+		Workers:     s.Workers,
+		BufferedLag: s.BufferedLag,
+		LossyLag:    s.LossyLag,
+		Clients:     len(broadcaster.Snapshot()),
+	}
+	durations := []struct {
+		d   time.Duration
+		out *string
+	}{{s.Window, &resp.CoalesceWindow}, {s.LossyFanOut, &resp.LossyFanOut}, {s.Hold, &resp.Hold}}
+	for _, d := range durations {
+		if d.d > 0 {
+			*d.out = d.d.String()
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// slowClientsHandler lists the clients furthest behind, with their
+// delivery stats: GET /admin/slow-clients?limit=10.
+func slowClientsHandler(w http.ResponseWriter, r *http.Request) {
+	type SlowClient struct {
+		broadcast.ClientStats
+		Session    string `json:"session"`
+		Nickname   string `json:"nickname,omitempty"`
+		RemoteAddr string `json:"remote_addr"`
+	}
+
+	limit := 10
+	if v := r.URL.Query().Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			http.Error(w, "Invalid limit", http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+
+	byID := make(map[string]*WebSocketClient)
+	for _, client := range hub.Snapshot() {
+		byID[client.ID] = client
+	}
+	resp := []SlowClient{}
+	for _, s := range broadcast.Slowest(broadcaster.Snapshot(), limit) {
+		sc := SlowClient{ClientStats: s}
+		if client, ok := byID[s.ID]; ok {
+			sc.Session = client.Session.ID
+			sc.Nickname = client.Session.Nickname()
+			sc.RemoteAddr = client.Conn.RemoteAddr().String()
+		}
+		resp = append(resp, sc)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// --------------------
+// WebSocket Handling
+// --------------------
+
+// sessionToken returns the token a client presented to resume its session,
+// from the query string or the session cookie.
+func sessionToken(r *http.Request) string {
+	if token := r.URL.Query().Get("token"); token != "" {
+		return token
+	}
+	if cookie, err := r.Cookie(sessionCookie); err == nil {
+		return cookie.Value
+	}
+	return ""
+}
+
+func cleanNickname(nickname string) string {
+	runes := []rune(nickname)
+	if len(runes) > maxNicknameLength {
+		runes = runes[:maxNicknameLength]
+	}
+	return string(runes)
+}
+
+// handleHost serves a host client: a browser that plays the raw MIDI
+// output in place of a local MIDI port. Hosts only receive.
+func handleHost(w http.ResponseWriter, r *http.Request) {
+	if midiManager.relay == nil {
+		http.Error(w, "relay mode is not enabled", http.StatusForbidden)
+		return
+	}
+	if relayKey != "" && r.URL.Query().Get("key") != relayKey {
+		http.Error(w, "invalid host key", http.StatusUnauthorized)
+		return
+	}
+
+	ws, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		logError("%v", err)
+		return
+	}
+	link := wsconn.New(ws, wsConfig)
+	host := relay.NewHost(ws.RemoteAddr().String(), hostQueueDepth)
+	midiManager.relay.Add(host)
+	logWS("Host client %s connected; relaying MIDI output.", host.ID)
+	record(journal.Entry{Level: journal.LevelInfo, Event: "host_connect", ClientID: host.ID})
+
+	go func() {
+		defer link.Close()
+		var seq uint64
+		for msg := range host.Send {
+			seq++
+			_, data, err := wire.JSON{}.Encode(msg, wire.Header{Seq: seq, Time: time.Now()})
+			if err == nil {
+				err = link.WriteMessage(websocket.TextMessage, data)
+			}
+			if err != nil {
+				logWS("Host write error: %v", err)
+				return
+			}
+		}
+	}()
+
+	// Reading only notices the host going away.
+	for {
+		if _, _, err := link.ReadMessage(); err != nil {
+			break
+		}
+	}
+	link.Close()
+	midiManager.relay.Remove(host)
+	logWS("Host client %s disconnected.", host.ID)
+	record(journal.Entry{Level: journal.LevelInfo, Event: "host_disconnect", ClientID: host.ID})
+}
+
 func handleConnections(w http.ResponseWriter, r *http.Request) {
 	upgrader.CheckOrigin = func(r *http.Request) bool { return true } // Allow all origins
 
-	ws, err := upgrader.Upgrade(w, r, nil)
+	if r.URL.Query().Get("role") == "host" {
+		handleHost(w, r)
+		return
+	}
+
+	sess, resumed := sessions.Resume(sessionToken(r))
+	if nickname := r.URL.Query().Get("nickname"); nickname != "" {
+		sess.SetNickname(cleanNickname(nickname))
+	}
+
+	header := http.Header{}
+	header.Add("Set-Cookie", (&http.Cookie{
+		Name:     sessionCookie,
+		Value:    sess.Token,
+		Path:     "/",
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	}).String())
+
+	ws, err := upgrader.Upgrade(w, r, header)
 	if err != nil {
 		logError("%v", err)
+		sessions.Release(sess)
 		return
 	}
-	logWS("New WebSocket connection established.")
+	clientID := sess.ID
+	if resumed {
+		logWS("Client %s reconnected.", clientID)
+	} else {
+		logWS("New WebSocket connection established: client %s.", clientID)
+	}
+	record(journal.Entry{Level: journal.LevelInfo, Event: "connect", ClientID: clientID, Message: fmt.Sprintf("resumed=%v", resumed)})
+
+	// A resumed client keeps its group; everyone else gets one assigned.
+	if groupAssigner != nil {
+		if _, ok := groupAssigner.Lookup(sess.Group()); !ok {
+			if g := groupAssigner.Assign(r.URL.Query().Get("seat")); g != nil {
+				sess.SetGroup(g.Name)
+				record(journal.Entry{Level: journal.LevelInfo, Event: "assign", ClientID: clientID, Message: g.Name})
+			}
+		}
+	}
 
 	atomic.AddInt64(&newConnectionsThisPeriod, 1)
 
 	client := &WebSocketClient{
-		Conn:  ws,
-		Send:  make(chan interface{}),
-		Timer: time.NewTimer(idleTimeout),
+		ID:      fmt.Sprintf("%s-%d", sess.ID, atomic.AddUint64(&connectionCount, 1)),
+		Conn:    ws,
+		Send:    broadcast.NewQueue(clientQueueDepth, clientQueuePolicy),
+		Timer:   time.NewTimer(idleTimeout),
+		Session: sess,
+		Codec:   wire.ForSubprotocol(ws.Subprotocol()),
+		link:    wsconn.New(ws, wsConfig),
+	}
+
+	// Queued before the client is registered so they are the first frames
+	// the client sees.
+	greeting := []interface{}{IdentityMessage{
+		Type:     "identity",
+		ID:       sess.ID,
+		Token:    sess.Token,
+		Nickname: sess.Nickname(),
+		Resumed:  resumed,
+	}}
+	if groupAssigner != nil {
+		greeting = append(greeting, newGroupMessage(client.Group()))
+	}
+	for _, msg := range greeting {
+		client.Send.Push(msg)
 	}
 	hub.Register(client)
 
 	go func() {
 		<-client.Timer.C
 		logTimeout("Idle timeout, closing WebSocket connection.")
-		client.Close()
+		record(journal.Entry{Level: journal.LevelWarn, Event: "timeout", ClientID: clientID})
+		client.CloseWith(wsconn.CloseIdle, "idle timeout")
 	}()
 
 	go func() {
-		defer client.Close()
+		defer client.drop()
 		for {
-			select {
-			case msg, ok := <-client.Send:
-				if !ok {
-					return
-				}
-				if err := ws.WriteJSON(msg); err != nil {
-					logWS("WebSocket write error: %v", err)
-					return
-				}
+			msg, seq, ok := client.Send.Pop()
+			if !ok {
+				return
+			}
+			start := time.Now()
+			if err := client.write(msg, seq); err != nil {
+				logWS("WebSocket write error: %v", err)
+				return
+			}
+			client.Send.Written(time.Since(start))
+			if client.Send.TakeResync() {
+				client.resync()
 			}
 		}
 	}()
 
 	for {
-		var incoming IncomingMessage
-		err := ws.ReadJSON(&incoming)
+		incoming, malformed, err := readIncoming(client.link)
 		if err != nil {
 			logWS("WebSocket read error: %v", err)
-			client.Close()
+			record(journal.Entry{Level: journal.LevelInfo, Event: "disconnect", ClientID: clientID, Message: err.Error()})
+			client.drop()
 			break
 		}
 
 		client.Timer.Reset(idleTimeout)
 
+		if malformed != nil {
+			client.replyError(errMalformed, "", "%v", malformed)
+			continue
+		}
+
 		switch incoming.Type {
+		case "hello":
+			if incoming.Version < wire.MinVersion {
+				client.replyError(errUnsupportedVersion, "hello", "protocol version %d is not supported; this server speaks %d to %d", incoming.Version, wire.MinVersion, wire.Version)
+				// The close frame repeats the reason in case the error
+				// message loses the race with the close.
+				client.CloseWith(websocket.CloseProtocolError, errUnsupportedVersion)
+				break
+			}
+			logWS("Client %s says hello: version %d, capabilities %v", clientID, incoming.Version, incoming.Capabilities)
+			client.Enqueue(newWelcomeMessage(ws.Subprotocol()))
+
 		case "nextScene":
-			logWS("Received nextScene request from client.")
+			logWS("Received nextScene request from client %s.", clientID)
+			record(journal.Entry{Level: journal.LevelInfo, Event: "nextScene", ClientID: clientID})
 			broadcastScene()
 
+		case "nickname":
+			sess.SetNickname(cleanNickname(incoming.Nickname))
+			logWS("Client %s is now known as %q", clientID, sess.Nickname())
+			record(journal.Entry{Level: journal.LevelInfo, Event: "nickname", ClientID: clientID, Message: sess.Nickname()})
+
 		case "note":
 			if incoming.Note == nil || incoming.Velocity == nil {
 				logError("Malformed 'note' message: missing fields")
+				client.replyError(errMalformed, "note", "note messages need note and velocity")
+				continue
+			}
+			group := client.Group()
+			if !group.Allows(*incoming.Note) {
+				record(journal.Entry{Level: journal.LevelDebug, Event: "rejected", ClientID: clientID, Note: incoming.Note, Message: "pad not in group"})
+				continue
+			}
+			if !sess.Allow(time.Now(), clientRateLimit, rateLimitWindow) {
+				record(journal.Entry{Level: journal.LevelDebug, Event: "rate_limited", ClientID: clientID, Note: incoming.Note})
 				continue
 			}
-			logWS("Parsed Note: %d, Velocity: %d", *incoming.Note, *incoming.Velocity)
-			hub.Broadcast <- MIDIMessage{Type: "note", Note: *incoming.Note, Velocity: *incoming.Velocity}
+			logNote("Client %s Note: %d, Velocity: %d", clientID, *incoming.Note, *incoming.Velocity)
+			record(journal.Entry{Level: journal.LevelInfo, Event: "note", ClientID: clientID, Note: incoming.Note, Velocity: incoming.Velocity, Scene: activeCue()})
+			msg := MIDIMessage{
+				Type:     "note",
+				Note:     *incoming.Note,
+				Velocity: *incoming.Velocity,
+				Channel:  group.MIDIChannel(),
+				From:     clientID,
+				Nickname: sess.Nickname(),
+				pressure: incoming.Pressure,
+				duration: incoming.Duration,
+			}
+			if group != nil {
+				msg.Group = group.Name
+			}
+			hub.Broadcast <- msg
+
+		default:
+			client.replyError(errUnknownType, incoming.Type, "unknown message type %q", incoming.Type)
 		}
 	}
 }
 
+// newWelcomeMessage lists what this server offers, so clients can adapt.
+func newWelcomeMessage(subprotocol string) WelcomeMessage {
+	protocol := subprotocol
+	if protocol == "" {
+		protocol = "json"
+	}
+	capabilities := []string{"nickname", "compact", "pressure"}
+	if groupAssigner != nil {
+		capabilities = append(capabilities, "groups")
+	}
+	if hub.Quantizer != nil {
+		capabilities = append(capabilities, "quantize")
+	}
+	if hubClock != nil {
+		capabilities = append(capabilities, "beats")
+	}
+	if clientRateLimit > 0 {
+		capabilities = append(capabilities, "rate-limit")
+	}
+	if _, ok := broadcaster.Current().(*broadcast.CoalescingBroadcaster); ok {
+		capabilities = append(capabilities, "batch")
+	}
+	return WelcomeMessage{
+		Type:         "welcome",
+		Server:       "midi-lab",
+		MinVersion:   wire.MinVersion,
+		Protocol:     protocol,
+		Capabilities: capabilities,
+	}
+}
+
+// readIncoming reads the next client message. Compact-protocol clients may
+// send notes as binary 3-byte note-ons; their channel is ignored, as the
+// group decides it. A frame that can't be decoded is returned as malformed
+// rather than as a read error, so the connection survives it.
+func readIncoming(ws *wsconn.Conn) (incoming IncomingMessage, malformed, err error) {
+	messageType, data, err := ws.ReadMessage()
+	if err != nil {
+		return incoming, nil, err
+	}
+	if messageType == websocket.BinaryMessage {
+		n, err := wire.DecodeNote(data)
+		if err != nil {
+			return incoming, err, nil
+		}
+		return IncomingMessage{Type: "note", Note: &n.Note, Velocity: &n.Velocity}, nil, nil
+	}
+	if err := json.Unmarshal(data, &incoming); err != nil {
+		return incoming, fmt.Errorf("invalid JSON: %v", err), nil
+	}
+	if incoming.Type == "" {
+		return incoming, fmt.Errorf("message has no type"), nil
+	}
+	return incoming, nil, nil
+}
+
 // --------------------
 // Hub Methods
 // --------------------
 
 func (h *Hub) Register(client *WebSocketClient) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
 	h.Clients[client.Conn] = client
+	h.Broadcaster.Add(client.ID, client)
 }
 
 func (h *Hub) Unregister(client *WebSocketClient) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
 	delete(h.Clients, client.Conn)
+	h.Broadcaster.Remove(client.ID)
+}
+
+// Snapshot returns the currently registered clients. Callers may close
+// clients while iterating, which unregisters them.
+func (h *Hub) Snapshot() []*WebSocketClient {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	clients := make([]*WebSocketClient, 0, len(h.Clients))
+	for _, client := range h.Clients {
+		clients = append(clients, client)
+	}
+	return clients
+}
+
+func (h *Hub) Len() int {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return len(h.Clients)
 }
 
 func (h *Hub) Run(ctx context.Context) {
 	for {
 		select {
 		case msg := <-h.Broadcast:
-			if m, ok := msg.(MIDIMessage); ok {
-				logMIDI("Broadcast Note: %d Velocity: %d", m.Note, m.Velocity)
-				atomic.AddInt64(&noteEventsThisPeriod, 1)
-
-				if m.Type == "note" {
-					noteStatusMutex.Lock()
-					if noteStatus[m.Note] {
-						noteStatusMutex.Unlock()
-						continue
-					}
-					noteStatus[m.Note] = true
-					noteStatusMutex.Unlock()
-
-					if midiManager != nil {
-						err := midiManager.NoteOn(m.Note, m.Velocity)
-						if err != nil {
-							logError("MIDI out error: %v", err)
-						}
-						go func(note uint8) {
-							time.Sleep(500 * time.Millisecond)
-							err := midiManager.NoteOff(note)
-							if err != nil {
-								if err.Error() != fmt.Sprintf("can't write channel.NoteOff channel 0 key %d. note is not running.", note) {
-									logError("MIDI out NoteOff error: %v", err)
-								}
-							}
-							noteStatusMutex.Lock()
-							noteStatus[note] = false
-							noteStatusMutex.Unlock()
-						}(m.Note)
-					}
-				}
-			}
+			share(msg)
+			h.accept(ctx, msg)
+
+		case msg := <-h.Remote:
+			h.accept(ctx, msg)
 
-			clients := make(map[*websocket.Conn]broadcast.ClientSender)
-			for conn, client := range h.Clients {
-				clients[conn] = client
+		case msg := <-h.Delayed:
+			if m, ok := msg.(MIDIMessage); ok && !m.expanded {
+				h.play(ctx, m)
+				continue
 			}
-			h.Broadcaster.Broadcast(clients, msg)
+			h.dispatch(msg)
 
 		case <-ctx.Done():
 			return
@@ -495,19 +1782,224 @@ func (h *Hub) Run(ctx context.Context) {
 	}
 }
 
+// accept takes a new message into the hub. Client notes are shaped by the
+// scene and quantized; everything else is dispatched at once.
+func (h *Hub) accept(ctx context.Context, msg interface{}) {
+	if m, ok := msg.(MIDIMessage); ok && m.From != "" {
+		now := time.Now()
+		sc := activeScene()
+		m.Velocity = sc.shape(m, crowd, now)
+		m.Note = sc.constrain(m.Note)
+		if h.Quantizer != nil {
+			at := h.Quantizer.Next(now)
+			m.At = at.UnixMilli()
+			h.after(ctx, at.Sub(now), m)
+			return
+		}
+		h.play(ctx, m)
+		return
+	}
+	h.dispatch(msg)
+}
+
+// after feeds msg back into the hub once d has passed.
+func (h *Hub) after(ctx context.Context, d time.Duration, msg interface{}) {
+	time.AfterFunc(d, func() {
+		select {
+		case h.Delayed <- msg:
+		case <-ctx.Done():
+		}
+	})
+}
+
+// tempo returns the current tempo for effects: the hub clock if it is
+// measuring one, else the quantizer, else 120 BPM.
+func (h *Hub) tempo() float64 {
+	if hubClock != nil {
+		if bpm := hubClock.Tempo(); bpm > 0 {
+			return bpm
+		}
+	}
+	if h.Quantizer != nil {
+		return h.Quantizer.Tempo()
+	}
+	return 120
+}
+
+// play applies the active scene's effects to a client note and dispatches
+// the resulting notes, now or later.
+func (h *Hub) play(ctx context.Context, m MIDIMessage) {
+	m.expanded = true
+	sc := activeScene()
+	if sc == nil || sc.Effects == nil {
+		h.dispatch(m)
+		return
+	}
+
+	start := time.Now()
+	for _, e := range sc.Effects.Apply(m.Note, m.Velocity, sc.constraint, h.tempo()) {
+		em := m
+		em.Note = e.Note
+		em.Velocity = e.Velocity
+		if e.Offset <= 0 {
+			h.dispatch(em)
+			continue
+		}
+		em.At = start.Add(e.Offset).UnixMilli()
+		em.repeat = true
+		h.after(ctx, e.Offset, em)
+	}
+}
+
+func noteOff(channel, note uint8) {
+	if err := oscOut.Note(channel, note, 0); err != nil {
+		logError("OSC out error: %v", err)
+	}
+	if midiManager == nil {
+		return
+	}
+	err := midiManager.NoteOff(channel, note)
+	if err != nil {
+		if err.Error() != fmt.Sprintf("can't write channel.NoteOff channel %d key %d. note is not running.", channel, note) {
+			logError("MIDI out NoteOff error: %v", err)
+		}
+	}
+}
+
+// dispatch plays a note on the MIDI output and sends msg to every client.
+func (h *Hub) dispatch(msg interface{}) {
+	if m, ok := msg.(MIDIMessage); ok {
+		logNote("Broadcast Note: %d Velocity: %d Channel: %d", m.Note, m.Velocity, m.Channel)
+		atomic.AddInt64(&noteEventsThisPeriod, 1)
+
+		if m.Type == "note" {
+			// Echoes and arpeggios often repeat a pitch that is still
+			// held; end it so the repeat isn't dropped as a duplicate.
+			if m.repeat && voiceAllocator.End(m.Channel, m.Note) {
+				noteOff(m.Channel, m.Note)
+			}
+			voice, stolen, ok := voiceAllocator.Acquire(m.Channel, m.Note, m.Velocity, time.Now())
+			if !ok {
+				return
+			}
+			if stolen != nil {
+				logNote("Stole Note: %d Channel: %d", stolen.Note, stolen.Channel)
+				record(journal.Entry{Level: journal.LevelDebug, Event: "voice_stolen", Note: &stolen.Note})
+				noteOff(stolen.Channel, stolen.Note)
+			}
+
+			if midiManager != nil {
+				err := midiManager.NoteOn(m.Channel, m.Note, m.Velocity)
+				if err != nil {
+					logError("MIDI out error: %v", err)
+					record(journal.Entry{Level: journal.LevelError, Event: "midi_error", ClientID: m.From, Note: &m.Note, Message: err.Error()})
+				}
+			}
+			if err := oscOut.Note(m.Channel, m.Note, m.Velocity); err != nil {
+				logError("OSC out error: %v", err)
+			}
+			go func(voice voices.Voice) {
+				time.Sleep(500 * time.Millisecond)
+				// A stolen or retriggered voice has already been silenced.
+				if voiceAllocator.Release(voice.ID) {
+					noteOff(voice.Channel, voice.Note)
+				}
+			}(voice)
+		}
+	}
+
+	h.Broadcaster.Broadcast(msg)
+}
+
 // --------------------
 // Main
 // --------------------
 
 func main() {
-	// Available broadcast modes:
-	// - default  => Immediate send, close slow clients
-	// - buffered => Allow 50ms grace for slow clients before closing (recommended)
-	// - batch    => Parallel sending with goroutines
-	// - lossy    => Skip slow clients without closing them
-	var broadcastMode = flag.String("broadcast-mode", "", "Broadcast mode: default, buffered, batch, lossy")
+	// Available broadcast modes (switchable later from /admin/broadcast):
+	// - default  => Queue immediately; a full queue applies its overflow policy
+	// - buffered => Allow a full queue 50ms to drain first (recommended)
+	// - batch    => Parallel sending, one goroutine per client
+	// - sharded  => Parallel sending over a fixed pool of workers
+	// - lossy    => Skip clients with a full queue without closing them
+	// - coalesce => Gather messages into one frame per client per window
+	// - adaptive => Move between default, buffered and lossy as clients lag
+	var broadcastMode = flag.String("broadcast-mode", "", "Broadcast mode: default, buffered, batch, lossy, coalesce, sharded, adaptive")
+	var coalesceWindow = flag.Duration("coalesce-window", broadcast.DefaultCoalesceWindow, "How long the coalesce broadcast mode gathers messages into one frame")
+	var logLevelName = flag.String("log-level", "info", "Console log level: debug, info, warn, error")
+	var journalPath = flag.String("journal", "", "Write a JSONL event journal of hub activity to this file")
+	var journalLevelName = flag.String("journal-level", "info", "Journal log level: debug, info, warn, error")
+	var journalMaxSize = flag.Int64("journal-max-size", 10, "Rotate the journal after this many megabytes (0 disables)")
+	var journalMaxAge = flag.Duration("journal-max-age", 24*time.Hour, "Rotate the journal after this long (0 disables)")
+	flag.BoolVar(&logNotes, "log-notes", true, "Log every note to the console")
+	flag.IntVar(&clientRateLimit, "client-rate", 0, "Maximum notes per second from a single client (0 disables)")
+	var groupsPath = flag.String("groups", "", "Partition clients into groups defined in this JSON file")
+	var groupModeName = flag.String("group-mode", "round-robin", "Group assignment: round-robin, seat (?seat= in the URL), admin")
+	var quantizeBPM = flag.Float64("quantize-bpm", 0, "Quantize client notes to a grid at this tempo (0 disables)")
+	var quantizeGrid = flag.String("quantize-grid", "1/16", "Quantize grid: 1/4, 1/8, 1/16, 1/32, 1/4t, 1/8t, 1/16t")
+	flag.BoolVar(&followClock, "quantize-midi-clock", false, "Follow the hub clock for the quantizer tempo and phase; without --clock, follows MIDI input clock")
+	flag.StringVar(&clockSource, "clock", "", "Clock source: midi (follow MIDI input clock), internal (generate clock to MIDI output), or empty for none")
+	var clockBPM = flag.Float64("clock-bpm", 120, "Tempo of the internal clock")
+	var beatsPerBar = flag.Int("beats-per-bar", 4, "Beats per bar for beat/bar broadcasts")
+	var maxVoices = flag.Int("max-voices", 0, "Maximum notes sounding at once on the MIDI output (0 is unlimited)")
+	var maxVoicesPerChannel = flag.Int("max-voices-per-channel", 0, "Maximum notes sounding at once per MIDI channel (0 is unlimited)")
+	var stealPolicyName = flag.String("voice-steal", "oldest", "Which note to cut when a voice limit is reached: none (drop the new note), oldest, quietest, lowest")
+	var sessionTTL = flag.Duration("session-ttl", 10*time.Minute, "How long a disconnected client's identity and state are kept for reconnects")
+	var oscOutAddr = flag.String("osc-out", "", "Send notes, scenes and controller moves as OSC to this host:port")
+	var oscInAddr = flag.String("osc-in", "", "Listen for OSC on this UDP address (e.g. :9000) to trigger notes and scenes")
+	flag.DurationVar(&wsConfig.PingInterval, "ws-ping-interval", wsconn.Default.PingInterval, "How often to ping WebSocket clients")
+	flag.DurationVar(&wsConfig.PongTimeout, "ws-pong-timeout", wsconn.Default.PongTimeout, "Drop a WebSocket client after this long without a pong or message")
+	flag.DurationVar(&wsConfig.WriteTimeout, "ws-write-timeout", wsconn.Default.WriteTimeout, "Drop a WebSocket client if a single write blocks this long")
+	flag.Int64Var(&wsConfig.MaxMessageSize, "ws-max-message", wsconn.Default.MaxMessageSize, "Largest WebSocket message accepted from a client, in bytes")
+	flag.IntVar(&clientQueueDepth, "client-queue", clientQueueDepth, "Messages buffered per WebSocket client before the overflow policy applies")
+	var clientOverflow = flag.String("client-overflow", string(clientQueuePolicy), "What a full client queue does: drop-oldest, drop-newest, coalesce (keep only the latest cue, beat, ...), disconnect")
+	var localMIDI = flag.Bool("local-midi", true, "Open local MIDI ports (set false to run headless with --relay or --rtpmidi)")
+	var relayMode = flag.Bool("relay", false, "Stream the MIDI output to host clients connected with /ws?role=host")
+	flag.StringVar(&relayKey, "relay-key", "", "Key host clients must pass as ?key= (empty allows any host)")
+	var rtpmidiAddr = flag.String("rtpmidi", "", "Host an RTP-MIDI (AppleMIDI) session on this UDP control port (e.g. :5004; data uses the next port)")
+	var rtpmidiName = flag.String("rtpmidi-name", "midi-lab", "Session name shown to RTP-MIDI peers")
+	var httpAddr = flag.String("addr", ":8080", "HTTP and WebSocket listen address")
+	var backplaneAddr = flag.String("backplane", "", "Share hub traffic and scenes with other instances: local, or host:port (or nats://host:port) of a backplane broker or NATS server")
+	var backplaneListen = flag.String("backplane-listen", "", "Host a backplane broker for other instances on this address (e.g. :4222)")
+	flag.StringVar(&instanceID, "instance", defaultInstanceID(), "Name of this instance on the backplane")
+	var rtpmidiPeers = flag.String("rtpmidi-peers", "", "Comma-separated host:port control ports of RTP-MIDI sessions to invite")
+	var oscAddressesPath = flag.String("osc-addresses", "", "JSON file overriding the OSC addresses for note, scene and control")
 	flag.Parse()
 
+	var err error
+	logLevel, err = journal.ParseLevel(*logLevelName)
+	if err != nil {
+		log.Fatalf("Invalid --log-level: %v", err)
+	}
+	if err := wsConfig.Validate(); err != nil {
+		log.Fatalf("Invalid WebSocket settings: %v", err)
+	}
+	if clientQueueDepth < 1 {
+		log.Fatalf("Invalid --client-queue: must be at least 1")
+	}
+	clientQueuePolicy, err = broadcast.ParsePolicy(*clientOverflow)
+	if err != nil {
+		log.Fatalf("Invalid --client-overflow: %v", err)
+	}
+
+	if *journalPath != "" {
+		journalLevel, err := journal.ParseLevel(*journalLevelName)
+		if err != nil {
+			log.Fatalf("Invalid --journal-level: %v", err)
+		}
+		eventJournal, err = journal.Open(journal.Options{
+			Path:    *journalPath,
+			MaxSize: *journalMaxSize * 1024 * 1024,
+			MaxAge:  *journalMaxAge,
+			Level:   journalLevel,
+		})
+		if err != nil {
+			log.Fatalf("Failed to open journal: %v", err)
+		}
+		defer eventJournal.Close()
+		logServer("Writing event journal to %s", *journalPath)
+	}
+
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
@@ -520,57 +2012,248 @@ func main() {
 		cancel()
 	}()
 
-	var err error
 	scenes, err = loadScenesFromFile("scenes.json")
 	if err != nil {
 		log.Fatalf("Failed to load scenes: %v", err)
 	}
 	logServer("Loaded %d scenes", len(scenes))
+	record(journal.Entry{Level: journal.LevelInfo, Event: "start", Message: fmt.Sprintf("loaded %d scenes", len(scenes))})
+
+	if *groupsPath != "" {
+		groupMode, err := groups.ParseMode(*groupModeName)
+		if err != nil {
+			log.Fatalf("Invalid --group-mode: %v", err)
+		}
+		loadedGroups, err := groups.LoadFromFile(*groupsPath)
+		if err != nil {
+			log.Fatalf("Failed to load groups: %v", err)
+		}
+		groupAssigner = groups.NewAssigner(loadedGroups, groupMode)
+		logServer("Loaded %d groups (%s assignment)", len(loadedGroups), groupMode)
+	}
+
+	stealPolicy, err := voices.ParsePolicy(*stealPolicyName)
+	if err != nil {
+		log.Fatalf("Invalid --voice-steal: %v", err)
+	}
+	voiceAllocator = voices.New(*maxVoices, *maxVoicesPerChannel, stealPolicy)
+
+	sessions = session.NewStore(*sessionTTL)
+	go func() {
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(sessionExpiryCheck):
+				if n := sessions.Expire(); n > 0 {
+					logServer("Expired %d idle client sessions", n)
+				}
+			}
+		}
+	}()
 
 	hub = &Hub{
 		Clients:   make(map[*websocket.Conn]*WebSocketClient),
 		Broadcast: make(chan interface{}),
 		Shutdown:  make(chan struct{}),
+		Delayed:   make(chan interface{}),
+		Remote:    make(chan interface{}),
 	}
 
-	switch *broadcastMode {
-	case "", "buffered":
-		hub.Broadcaster = &broadcast.BufferedBroadcaster{}
-	case "default":
-		hub.Broadcaster = &broadcast.DefaultBroadcaster{}
-	case "batch":
-		hub.Broadcaster = &broadcast.BatchBroadcaster{}
-	case "lossy":
-		hub.Broadcaster = &broadcast.LossyBroadcaster{}
+	if *quantizeBPM > 0 {
+		gridBeats, err := quantize.ParseGrid(*quantizeGrid)
+		if err != nil {
+			log.Fatalf("Invalid --quantize-grid: %v", err)
+		}
+		hub.Quantizer = quantize.New(*quantizeBPM, gridBeats)
+		logServer("Quantizing client notes to %s at %.1f BPM", *quantizeGrid, *quantizeBPM)
+	}
+
+	// --quantize-midi-clock on its own follows the MIDI input's clock, as
+	// it did before --clock existed.
+	if followClock && clockSource == "" {
+		clockSource = "midi"
+	}
+	switch clockSource {
+	case "":
+	case "midi", "internal":
+		if clockSource == "internal" && *clockBPM <= 0 {
+			log.Fatalf("Invalid --clock-bpm: must be above 0")
+		}
+		hubClock = clock.New(*beatsPerBar, onBeat)
 	default:
-		log.Fatalf("Unknown broadcast mode: %s", *broadcastMode)
+		log.Fatalf("Unknown clock source: %s", clockSource)
 	}
 
-	midiManager = &MIDIManager{}
-	err = midiManager.Setup()
+	broadcastConfig = broadcastSettings{Mode: *broadcastMode, Window: *coalesceWindow}
+	if broadcastConfig.Mode == "" {
+		broadcastConfig.Mode = "buffered"
+	}
+	initial, err := broadcastConfig.newBroadcaster()
 	if err != nil {
-		logError("%v", err)
+		log.Fatalf("Invalid --broadcast-mode: %v", err)
+	}
+	broadcaster = broadcast.NewSwitchable(initial)
+	hub.Broadcaster = broadcaster
+	logServer("Broadcast mode: %s", broadcastConfig)
+
+	// MIDI input, the backplane and the hub all send OSC, so the output
+	// is ready before any of them start.
+	oscAddresses := osc.DefaultAddresses
+	if *oscAddressesPath != "" {
+		oscAddresses, err = osc.LoadAddresses(*oscAddressesPath)
+		if err != nil {
+			log.Fatalf("Failed to load OSC addresses: %v", err)
+		}
+	}
+	if *oscOutAddr != "" {
+		oscOut, err = osc.Dial(*oscOutAddr, oscAddresses)
+		if err != nil {
+			log.Fatalf("Failed to open OSC output: %v", err)
+		}
+		defer oscOut.Close()
+		logOSC("Sending OSC to %s", *oscOutAddr)
+	}
+
+	midiManager = &MIDIManager{}
+	if *localMIDI {
+		err = midiManager.Setup()
+		if err != nil {
+			logError("%v", err)
+		}
+	} else {
+		logMIDI("Local MIDI ports disabled")
+	}
+
+	if *relayMode {
+		midiManager.relay = relay.New()
+		midiManager.mirrors = append(midiManager.mirrors, midiManager.relay)
+		logMIDI("Relaying MIDI output to host clients at /ws?role=host")
+	}
+
+	if *rtpmidiAddr != "" {
+		midiManager.network, err = rtpmidi.Listen(*rtpmidiName, *rtpmidiAddr)
+		if err != nil {
+			log.Fatalf("Failed to start RTP-MIDI session: %v", err)
+		}
+		midiManager.mirrors = append(midiManager.mirrors, midiManager.network)
+		go midiManager.ListenNetwork(ctx)
+		logMIDI("RTP-MIDI session %q on %s", *rtpmidiName, midiManager.network.Addr())
+
+		for _, peer := range strings.Split(*rtpmidiPeers, ",") {
+			if peer = strings.TrimSpace(peer); peer == "" {
+				continue
+			}
+			go func(addr string) {
+				p, err := midiManager.network.Invite(ctx, addr)
+				if err != nil {
+					logError("RTP-MIDI invite %s: %v", addr, err)
+					return
+				}
+				logMIDI("RTP-MIDI session joined by %q at %s", p.Name, addr)
+			}(peer)
+		}
 	}
 
 	midiManager.FlushAllNotes()
 
+	if *backplaneListen != "" {
+		broker, err := backplane.Listen(*backplaneListen)
+		if err != nil {
+			log.Fatalf("Failed to start backplane broker: %v", err)
+		}
+		go func() {
+			if err := broker.Serve(ctx); err != nil {
+				logError("Backplane broker error: %v", err)
+			}
+		}()
+		logBackplane("Backplane broker listening on %s", broker.Addr())
+		if *backplaneAddr == "" {
+			*backplaneAddr = broker.Addr().String()
+		}
+	}
+	switch *backplaneAddr {
+	case "":
+	case "local":
+		bus = backplane.NewLocal()
+	default:
+		client, err := backplane.Dial(*backplaneAddr)
+		if err != nil {
+			log.Fatalf("Failed to connect to backplane: %v", err)
+		}
+		client.OnDisconnect = func(err error) {
+			logError("Backplane connection lost: %v", err)
+			record(journal.Entry{Level: journal.LevelWarn, Event: "backplane_down", Message: err.Error()})
+		}
+		client.OnReconnect = func() {
+			logBackplane("Backplane reconnected")
+			record(journal.Entry{Level: journal.LevelInfo, Event: "backplane_up"})
+			publishShared(sharedMessage{Sync: true})
+		}
+		go client.Serve(ctx)
+		bus = client
+	}
+	if bus != nil {
+		defer bus.Close()
+		if err := joinBackplane(); err != nil {
+			log.Fatalf("Failed to join backplane: %v", err)
+		}
+		logBackplane("Sharing hub traffic as instance %s via %s", instanceID, *backplaneAddr)
+	}
+
 	go hub.Run(ctx)
 
+	if *oscInAddr != "" {
+		listener, err := osc.Listen(*oscInAddr, oscAddresses, oscHandlers())
+		if err != nil {
+			log.Fatalf("Failed to listen for OSC: %v", err)
+		}
+		go func() {
+			if err := listener.Serve(ctx); err != nil {
+				logError("OSC listener error: %v", err)
+			}
+		}()
+		logOSC("Listening for OSC on %s", listener.Addr())
+	}
+
 	fs := http.FileServer(http.Dir("./static"))
 	http.Handle("/", fs)
 	http.HandleFunc("/ws", handleConnections)
 	http.HandleFunc("/stats", statsHandler)
 	http.HandleFunc("/reload-scenes", reloadScenesHandler)
+	http.HandleFunc("/admin/groups", groupsHandler)
+	http.HandleFunc("/admin/assign", assignGroupHandler)
+	http.HandleFunc("/admin/broadcast", broadcastHandler)
+	http.HandleFunc("/admin/slow-clients", slowClientsHandler)
 
-	server := &http.Server{Addr: ":8080"}
+	server := &http.Server{Addr: *httpAddr}
 
 	go midiManager.Listen()
 
+	if clockSource == "internal" {
+		var warned bool
+		generator := &clock.Generator{
+			BPM:   *clockBPM,
+			Clock: hubClock,
+			Send: func(status byte) {
+				if err := midiManager.SendRealtime(status); err != nil && !warned {
+					logError("MIDI clock out error: %v", err)
+					warned = true
+				}
+			},
+		}
+		go generator.Run(ctx)
+		logServer("Generating MIDI clock at %.1f BPM", *clockBPM)
+	}
+
 	go func() {
 		for {
 			select {
 			case <-ctx.Done():
 				return
+			case <-sceneMoved:
+				// Another instance moved the show on; wait a full
+				// interval from there so instances stay in step.
 			case <-time.After(sceneInterval):
 				broadcastScene()
 			}
@@ -588,8 +2271,9 @@ func main() {
 	server.Shutdown(context.Background())
 	midiManager.FlushAllNotes()
 	midiManager.Close()
-	for _, client := range hub.Clients {
-		client.Close()
+	for _, client := range hub.Snapshot() {
+		client.CloseWith(websocket.CloseGoingAway, "server shutting down")
 	}
+	record(journal.Entry{Level: journal.LevelInfo, Event: "shutdown"})
 	logServer("Server shutdown complete.")
 }
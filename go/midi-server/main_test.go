@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/radcliffetech/midi-lab/go/midi-server/internal/broadcast"
+	"github.com/radcliffetech/midi-lab/go/midi-server/internal/effects"
+	"github.com/radcliffetech/midi-lab/go/midi-server/internal/voices"
+)
+
+// recordingSink collects what the hub writes to the MIDI output.
+type recordingSink struct {
+	mu   sync.Mutex
+	msgs [][]byte
+}
+
+func (s *recordingSink) Send(msgs ...[]byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, m := range msgs {
+		s.msgs = append(s.msgs, append([]byte(nil), m...))
+	}
+	return nil
+}
+
+// notes describes the notes written so far as "on note/velocity" and
+// "off note".
+func (s *recordingSink) notes() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var out []string
+	for _, m := range s.msgs {
+		switch {
+		case len(m) == 3 && m[0]&0xF0 == 0x90:
+			out = append(out, fmt.Sprintf("on %d/%d", m[1], m[2]))
+		case len(m) == 3 && m[0]&0xF0 == 0x80:
+			out = append(out, fmt.Sprintf("off %d", m[1]))
+		}
+	}
+	return out
+}
+
+// failingSink is a mirror whose peer has gone away.
+type failingSink struct{}
+
+func (failingSink) Send(...[]byte) error { return errors.New("unreachable") }
+
+func TestMirrorContinuesPastFailingSink(t *testing.T) {
+	sink := &recordingSink{}
+	m := &MIDIManager{mirrors: []midiSink{failingSink{}, sink}}
+	if err := m.NoteOn(0, 60, 100); err == nil {
+		t.Error("NoteOn hid the failed mirror")
+	}
+	if got := fmt.Sprint(sink.notes()); got != "[on 60/100]" {
+		t.Errorf("later sink got %s, want the note", got)
+	}
+}
+
+func TestEchoRepeatsReachMIDIOutput(t *testing.T) {
+	sink := &recordingSink{}
+	midiManager = &MIDIManager{mirrors: []midiSink{sink}}
+	voiceAllocator = voices.New(0, 0, voices.StealOldest)
+	// The default 1/8 echo at 120 BPM repeats every 250ms, well inside
+	// the time a note is held.
+	scenes = []Scene{{Effects: &effects.Config{Echo: &effects.Echo{Repeats: 2}}}}
+	currentScene = 1
+
+	h := &Hub{Broadcaster: &broadcast.DefaultBroadcaster{}, Delayed: make(chan interface{})}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go h.Run(ctx)
+	h.Delayed <- MIDIMessage{Type: "note", Note: 60, Velocity: 100, From: "client-1"}
+
+	// Each repeat ends the held note first; the last is released as usual.
+	want := "[on 60/100 off 60 on 60/60 off 60 on 60/36 off 60]"
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		got := fmt.Sprint(sink.notes())
+		if got == want {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("notes = %s, want %s", got, want)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if s := voiceAllocator.Stats(); s.Duplicates != 0 {
+		t.Errorf("repeats counted as duplicates: %+v", s)
+	}
+}
+
+func TestFollowSceneIgnoresStaleChanges(t *testing.T) {
+	hub = &Hub{Clients: make(map[*websocket.Conn]*WebSocketClient)}
+	scenes = []Scene{{Cue: "one"}, {Cue: "two"}, {Cue: "three"}}
+	currentScene, sceneSeq, instanceID = 1, 0, "b"
+
+	steps := []struct {
+		origin string
+		number int
+		seq    uint64
+		want   int
+	}{
+		{"a", 2, 5, 2}, // newer: followed
+		{"c", 3, 4, 2}, // a late sync reply: ignored
+		{"c", 3, 5, 2}, // made at the same time by a higher ID: ignored
+		{"a", 3, 5, 3}, // made at the same time by a lower ID: followed
+		{"c", 1, 6, 1},
+	}
+	for i, s := range steps {
+		followScene(s.origin, s.number, s.seq)
+		if currentScene != s.want {
+			t.Errorf("step %d: scene %d from %s (seq %d) left scene %d, want %d", i, s.number, s.origin, s.seq, currentScene, s.want)
+		}
+	}
+	if sceneSeq != 6 {
+		t.Errorf("sceneSeq = %d, want 6", sceneSeq)
+	}
+}